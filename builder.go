@@ -0,0 +1,188 @@
+package orm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// QueryBuilder 链式的查询构造器，通过ORM.From或者ORMTran.From创建，
+// 表名和字段映射沿用struct的TableName方法和db标签，where条件中的??会和Exec一样展开为IN列表
+type QueryBuilder struct {
+	ctx     context.Context
+	reader  Tdx //查询使用的连接，读写分离时为从库
+	tdx     Tdx
+	table   string
+	columns []string
+	wheres  []string
+	args    []interface{}
+	orders  []string
+	limit   int
+	offset  int
+
+	softDelete string //软删除字段，不为空时查询会排除已经删除的记录，Delete只设置删除时间
+}
+
+func newQueryBuilder(c context.Context, reader Tdx, tdx Tdx, model interface{}) *QueryBuilder {
+	q := &QueryBuilder{
+		ctx:    c,
+		reader: reader,
+		tdx:    tdx,
+		table:  getTableName(model),
+	}
+	if f := softDeleteField(c, reflect.Indirect(reflect.ValueOf(model)).Type()); f != nil {
+		q.softDelete = f.column
+	}
+	return q
+}
+
+// Columns 指定查询的字段，默认为*
+func (q *QueryBuilder) Columns(cols ...string) *QueryBuilder {
+	q.columns = append(q.columns, cols...)
+	return q
+}
+
+// Where 增加一个查询条件，多次调用之间为AND关系
+func (q *QueryBuilder) Where(cond string, args ...interface{}) *QueryBuilder {
+	q.wheres = append(q.wheres, cond)
+	q.args = append(q.args, args...)
+	return q
+}
+
+// OrderBy 增加排序条件，例如OrderBy("id desc")
+func (q *QueryBuilder) OrderBy(orders ...string) *QueryBuilder {
+	q.orders = append(q.orders, orders...)
+	return q
+}
+
+func (q *QueryBuilder) Limit(limit int) *QueryBuilder {
+	q.limit = limit
+	return q
+}
+
+// 只有Offset没有Limit时使用的LIMIT，MySQL中LIMIT的最大值
+const maxLimit = "18446744073709551615"
+
+func (q *QueryBuilder) Offset(offset int) *QueryBuilder {
+	q.offset = offset
+	return q
+}
+
+func (q *QueryBuilder) whereSQL() string {
+	wheres := q.wheres
+	if q.softDelete != "" {
+		wheres = append(wheres[:len(wheres):len(wheres)], q.softDelete+" IS NULL")
+	}
+	if len(wheres) == 0 {
+		return ""
+	}
+	return " WHERE (" + strings.Join(wheres, ") AND (") + ")"
+}
+
+func (q *QueryBuilder) selectSQL(cols string) string {
+	buf := strings.Builder{}
+	buf.WriteString("SELECT ")
+	buf.WriteString(cols)
+	buf.WriteString(" FROM ")
+	buf.WriteString(q.table)
+	buf.WriteString(q.whereSQL())
+	if len(q.orders) > 0 {
+		buf.WriteString(" ORDER BY ")
+		buf.WriteString(strings.Join(q.orders, ","))
+	}
+	if q.limit > 0 {
+		buf.WriteString(fmt.Sprintf(" LIMIT %d", q.limit))
+	} else if q.offset > 0 {
+		//MySQL的OFFSET必须和LIMIT一起使用，没有Limit时使用最大值表示不限制
+		buf.WriteString(" LIMIT " + maxLimit)
+	}
+	if q.offset > 0 {
+		buf.WriteString(fmt.Sprintf(" OFFSET %d", q.offset))
+	}
+	return buf.String()
+}
+
+func (q *QueryBuilder) columnSQL() string {
+	if len(q.columns) == 0 {
+		return "*"
+	}
+	return strings.Join(q.columns, ",")
+}
+
+// Find 查询结果到slice中，和ORM.Select一样会加载关联
+func (q *QueryBuilder) Find(s interface{}) error {
+	return selectMany(q.ctx, q.reader, s, q.selectSQL(q.columnSQL()), q.args...)
+}
+
+// First 查询第一条结果，没有结果时返回ErrRecordNotFound
+func (q *QueryBuilder) First(s interface{}) error {
+	first := *q
+	first.limit = 1
+	return selectOne(q.ctx, q.reader, s, first.selectSQL(q.columnSQL()), q.args...)
+}
+
+// Count 统计满足条件的记录数，忽略Limit和OrderBy
+func (q *QueryBuilder) Count() (int64, error) {
+	return selectInt(q.ctx, q.reader, "SELECT COUNT(*) FROM "+q.table+q.whereSQL(), q.args...)
+}
+
+// Exists 判断是否存在满足条件的记录
+func (q *QueryBuilder) Exists() (bool, error) {
+	_, err := selectInt(q.ctx, q.reader, "SELECT 1 FROM "+q.table+q.whereSQL()+" LIMIT 1", q.args...)
+	if errors.Is(err, ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Update 按照条件更新字段，fields的key为数据库中的字段名，返回影响的行数。
+// 为了防止误操作，必须至少有一个Where条件
+func (q *QueryBuilder) Update(fields map[string]interface{}) (int64, error) {
+	if len(fields) == 0 {
+		return 0, errors.New("no fields to update for table " + q.table)
+	}
+	if len(q.wheres) == 0 {
+		return 0, errors.New("update " + q.table + " without where condition is not allowed")
+	}
+	cols := make([]string, 0, len(fields))
+	for col := range fields {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	sets := make([]string, len(cols))
+	args := make([]interface{}, 0, len(cols)+len(q.args))
+	for i, col := range cols {
+		sets[i] = col + " = ?"
+		args = append(args, fields[col])
+	}
+	args = append(args, q.args...)
+	return q.exec("UPDATE "+q.table+" SET "+strings.Join(sets, ",")+q.whereSQL(), args...)
+}
+
+// Delete 按照条件删除记录，返回影响的行数，有软删除字段时只设置删除时间。为了防止误操作，必须至少有一个Where条件
+func (q *QueryBuilder) Delete() (int64, error) {
+	if len(q.wheres) == 0 {
+		return 0, errors.New("delete from " + q.table + " without where condition is not allowed")
+	}
+	if q.softDelete != "" {
+		return q.exec("UPDATE "+q.table+" SET "+q.softDelete+" = ?"+q.whereSQL(), append([]interface{}{currentTime()}, q.args...)...)
+	}
+	return q.exec("DELETE FROM "+q.table+q.whereSQL(), q.args...)
+}
+
+func (q *QueryBuilder) exec(query string, args ...interface{}) (int64, error) {
+	if len(q.orders) > 0 {
+		query += " ORDER BY " + strings.Join(q.orders, ",")
+	}
+	if q.limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.limit)
+	}
+	ret, err := exec(q.ctx, q.tdx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return ret.RowsAffected()
+}
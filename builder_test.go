@@ -0,0 +1,93 @@
+package orm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+)
+
+func TestQueryBuilderSQL(t *testing.T) {
+	o := &ORM{}
+	q := o.From(&TestOrmA123{}).Where("other_id > ?", 1).Where("test_id in (??)", []int{1, 2}).
+		OrderBy("test_id desc").Limit(20).Offset(40)
+	assert.Equal(t, q.selectSQL(q.columnSQL()),
+		"SELECT * FROM test_orm_a123 WHERE (other_id > ?) AND (test_id in (??)) ORDER BY test_id desc LIMIT 20 OFFSET 40")
+	assert.Equal(t, len(q.args), 2)
+
+	q = o.From(TestOrmF123{}).Columns("id", "name")
+	assert.Equal(t, q.selectSQL(q.columnSQL()), "SELECT id,name FROM orm_f")
+
+	q = o.From(TestOrmF123{}).Offset(10)
+	assert.Equal(t, q.selectSQL(q.columnSQL()), "SELECT * FROM orm_f LIMIT 18446744073709551615 OFFSET 10")
+
+	if _, err := o.From(&TestOrmF123{}).Delete(); err == nil {
+		t.Fatal("delete without where should fail")
+	}
+	if _, err := o.From(&TestOrmF123{}).Update(map[string]interface{}{"name": "a"}); err == nil {
+		t.Fatal("update without where should fail")
+	}
+}
+
+func TestQueryBuilder(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		for i := 0; i < 10; i++ {
+			testObj := &TestOrmA123{
+				OtherId:     int64(i % 2),
+				Description: "builder test",
+				StartDate:   time.Now(),
+				EndDate:     time.Now(),
+			}
+			if err := orm.Insert(testObj); err != nil {
+				t.Fatal(err)
+			}
+			orm.Insert(&TestOrmC111{Name: "c", TestID: testObj.TestID})
+		}
+
+		var list []*TestOrmA123
+		err := orm.From(&TestOrmA123{}).Where("other_id = ?", 1).Where("test_id in (??)", []int64{2, 4, 5}).
+			OrderBy("test_id desc").Limit(20).Find(&list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(list), 2)
+		assert.Equal(t, list[0].TestID, int64(4))
+		assert.Equal(t, len(list[0].OrmCs), 1)
+
+		var first TestOrmA123
+		if err := orm.From(&TestOrmA123{}).OrderBy("test_id desc").Offset(1).First(&first); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, first.TestID, int64(9))
+
+		n, err := orm.From(&TestOrmA123{}).Where("other_id = ?", 0).Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, n, int64(5))
+
+		ok, err := orm.From(&TestOrmA123{}).Where("other_id = ?", 3).Exists()
+		if err != nil || ok {
+			t.Fatal("should not exist", err)
+		}
+
+		n, err = orm.From(&TestOrmA123{}).Where("other_id = ?", 0).Update(map[string]interface{}{"description": "updated"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, n, int64(5))
+
+		err = orm.DoTransaction(func(ot *ORMTran) error {
+			n, err := ot.From(&TestOrmA123{}).Where("description = ?", "updated").Delete()
+			assert.Equal(t, n, int64(5))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err = orm.From(&TestOrmA123{}).Where("description = ?", "updated").Exists()
+		if err != nil || ok {
+			t.Fatal("should be deleted", err)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+)
+
+// Config NewORMWithConfig的配置，为零值的项使用默认值
+type Config struct {
+	DriverName      string        //默认为mysql
+	DSN             string        //主库
+	ReplicaDSNs     []string      //从库，读操作会分配到从库上
+	ReplicaPolicy   ReplicaPolicy //从库的负载均衡策略，默认为RoundRobinPolicy
+	MaxOpenConns    int           //默认为100
+	MaxIdleConns    int           //默认为5
+	ConnMaxLifetime time.Duration //默认为10分钟
+	ConnMaxIdleTime time.Duration //默认不限制
+	PingTimeout     time.Duration //大于0时创建后会ping所有数据库，连接失败时返回错误
+	Logger          SqlLogger     //为空时使用SetLog设置的全局logger
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.DriverName == "" {
+		cfg.DriverName = "mysql"
+	}
+	if cfg.MaxOpenConns == 0 {
+		cfg.MaxOpenConns = 100
+	}
+	if cfg.MaxIdleConns == 0 {
+		cfg.MaxIdleConns = 5
+	}
+	if cfg.ConnMaxLifetime == 0 {
+		cfg.ConnMaxLifetime = time.Minute * 10
+	}
+	if cfg.ReplicaPolicy == nil {
+		cfg.ReplicaPolicy = &RoundRobinPolicy{}
+	}
+}
+
+func (cfg *Config) open(ds string) (*sql.DB, error) {
+	db, err := sql.Open(cfg.DriverName, ds)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+	if cfg.PingTimeout > 0 {
+		c, cancel := context.WithTimeout(context.Background(), cfg.PingTimeout)
+		defer cancel()
+		if err := db.PingContext(c); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// NewORMWithConfig 按照配置创建ORM，连接失败时返回错误
+func NewORMWithConfig(cfg Config) (*ORM, error) {
+	if cfg.DSN == "" {
+		return nil, errors.New("dsn should not be empty")
+	}
+	cfg.setDefaults()
+	db, err := cfg.open(cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	ret := NewORMFromDB(db)
+	ret.logger = cfg.Logger
+	ret.policy = cfg.ReplicaPolicy
+	for _, ds := range cfg.ReplicaDSNs {
+		replica, err := cfg.open(ds)
+		if err != nil {
+			ret.Close()
+			return nil, err
+		}
+		ret.replicas = append(ret.replicas, replica)
+	}
+	return ret, nil
+}
+
+// NewORMFromDB 使用已有的连接池创建ORM，连接池的配置由调用方负责
+func NewORMFromDB(db *sql.DB) *ORM {
+	initOnce.Do(func() {
+		sqlParamReg, _ = regexp.Compile("(#{[a-zA-Z0-9-_]*})")
+	})
+	return &ORM{
+		db:     db,
+		tables: make(map[string]interface{}),
+	}
+}
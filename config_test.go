@@ -0,0 +1,82 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+)
+
+func TestNewORMWithConfigError(t *testing.T) {
+	if _, err := NewORMWithConfig(Config{}); err == nil {
+		t.Fatal("empty dsn should fail")
+	}
+	if _, err := NewORMWithConfig(Config{DriverName: "unknown", DSN: "root@/orm_test"}); err == nil {
+		t.Fatal("unknown driver should fail")
+	}
+	_, err := NewORMWithConfig(Config{
+		DSN:         "root@tcp(127.0.0.1:1)/orm_test?timeout=100ms",
+		PingTimeout: time.Second,
+	})
+	if err == nil {
+		t.Fatal("ping should fail")
+	}
+}
+
+type collectSqlLogger struct {
+	sqls []string
+}
+
+func (l *collectSqlLogger) Log(c context.Context, sqlLog *SqlLog) {
+	l.sqls = append(l.sqls, sqlLog.Sql)
+}
+
+func (l *collectSqlLogger) ShowExplain(dur time.Duration) bool {
+	return false
+}
+
+func TestNewORMWithConfig(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		logger := &collectSqlLogger{}
+		o, err := NewORMWithConfig(Config{
+			DSN:          "root@/orm_test?parseTime=true&loc=Local",
+			MaxOpenConns: 10,
+			MaxIdleConns: 2,
+			PingTimeout:  time.Second,
+			Logger:       logger,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer o.Close()
+		assert.Equal(t, o.db.Stats().MaxOpenConnections, 10)
+		if err := o.Insert(&TestOrmA123{OtherId: 1, Description: "config"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.DoTransaction(func(ot *ORMTran) error {
+			_, err := ot.SelectInt("select count(*) from test_orm_a123")
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(logger.sqls), 2)
+	})
+}
+
+func TestNewORMFromDB(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		db, err := sql.Open("mysql", "root@/orm_test?parseTime=true&loc=Local")
+		if err != nil {
+			t.Fatal(err)
+		}
+		o := NewORMFromDB(db)
+		defer o.Close()
+		n, err := o.SelectInt("select count(*) from test_orm_a123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, n, int64(0))
+	})
+}
@@ -0,0 +1,141 @@
+package orm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// DirtyTracker 嵌入到model中开启修改跟踪，例如
+//
+//	type User struct {
+//		orm.DirtyTracker
+//		ID   int64 `db:"id,pk,ai"`
+//		Name string
+//	}
+//
+// 查询、插入和更新成功之后会保存字段的快照，UpdateChanged只更新和快照不同的字段
+type DirtyTracker struct {
+	snapshot map[int]interface{} //field下标 -> 保存快照时的值，没有快照的字段视为已修改
+}
+
+func (d *DirtyTracker) dirtyTracker() *DirtyTracker {
+	return d
+}
+
+type dirtyTrackable interface {
+	dirtyTracker() *DirtyTracker
+}
+
+var (
+	dirtyTrackerType   = reflect.TypeOf(DirtyTracker{})
+	dirtyTrackableType = reflect.TypeOf((*dirtyTrackable)(nil)).Elem()
+)
+
+// t为struct类型，嵌入了DirtyTracker时需要保存快照
+func isDirtyTracked(t reflect.Type) bool {
+	return reflect.PtrTo(t).Implements(dirtyTrackableType)
+}
+
+// 查询到的struct需要在加载完成之后处理
+func needAfterLoad(t reflect.Type) bool {
+	return hasAfterFind(t) || isDirtyTracked(t)
+}
+
+// 查询到的struct加载完成之后先调用AfterFind，再保存快照
+func afterLoad(c context.Context, tdx Tdx, t reflect.Type, values []reflect.Value) error {
+	if err := afterFind(c, tdx, t, values); err != nil {
+		return err
+	}
+	if isDirtyTracked(t) {
+		for _, v := range values {
+			saveSnapshot(v.Elem(), nil)
+		}
+	}
+	return nil
+}
+
+// 保存v中fields的快照，fields为nil时保存所有数据库字段，v为struct
+func saveSnapshot(v reflect.Value, fields []*modelField) {
+	d, ok := v.Addr().Interface().(dirtyTrackable)
+	if !ok {
+		return
+	}
+	tracker := d.dirtyTracker()
+	if tracker.snapshot == nil {
+		tracker.snapshot = map[int]interface{}{}
+	}
+	if fields == nil {
+		for _, f := range getModelMeta(v.Type()).fields {
+			if !f.ignore {
+				fields = append(fields, f)
+			}
+		}
+	}
+	for _, f := range fields {
+		tracker.snapshot[f.index] = cloneValue(v.Field(f.index))
+	}
+}
+
+// 复制字段的值，[]byte和指针指向的值也需要复制，避免原地修改后和快照相同
+func cloneValue(fv reflect.Value) interface{} {
+	switch {
+	case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Uint8:
+		if fv.IsNil() {
+			return fv.Interface()
+		}
+		return reflect.ValueOf(append([]byte{}, fv.Bytes()...)).Convert(fv.Type()).Interface()
+	case fv.Kind() == reflect.Ptr && !fv.IsNil():
+		nv := reflect.New(fv.Type().Elem())
+		nv.Elem().Set(fv.Elem())
+		return nv.Interface()
+	}
+	return fv.Interface()
+}
+
+func sameValue(old interface{}, fv reflect.Value) bool {
+	switch cur := fv.Interface().(type) {
+	case time.Time:
+		t, ok := old.(time.Time)
+		return ok && t.Equal(cur)
+	case []byte:
+		b, ok := old.([]byte)
+		return ok && (b == nil) == (cur == nil) && bytes.Equal(b, cur)
+	}
+	return reflect.DeepEqual(old, cloneValue(fv))
+}
+
+// 和快照相比修改过的字段，不包含主键和版本号
+func changedFields(v reflect.Value) []*modelField {
+	m := getModelMeta(v.Type())
+	snapshot := v.Addr().Interface().(dirtyTrackable).dirtyTracker().snapshot
+	ret := make([]*modelField, 0)
+	for _, f := range m.inserts {
+		if f.pk || f == m.version {
+			continue
+		}
+		if old, ok := snapshot[f.index]; ok && sameValue(old, v.Field(f.index)) {
+			continue
+		}
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+// 只更新和快照相比修改过的字段，没有修改时不执行sql，s需要嵌入DirtyTracker
+func updateChanged(c context.Context, tdx Tdx, s interface{}) error {
+	t := reflect.TypeOf(s)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct || !isDirtyTracked(t.Elem()) {
+		return fmt.Errorf("%s should be pointer of struct which embeds orm.DirtyTracker", t)
+	}
+	if err := beforeUpdate(c, tdx, s); err != nil {
+		return err
+	}
+	fields := changedFields(reflect.ValueOf(s).Elem())
+	if len(fields) == 0 {
+		return nil
+	}
+	return updateModelFields(c, tdx, s, fields)
+}
@@ -0,0 +1,99 @@
+package orm
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+)
+
+type TestOrmTrackedUser struct {
+	DirtyTracker
+	ID       int64  `db:"id,pk,ai"`
+	UserName string `db:"name"`
+}
+
+func (u *TestOrmTrackedUser) TableName() string {
+	return "test_orm_user"
+}
+
+func TestUpdateChanged(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		logger := &collectSqlLogger{}
+		o, err := NewORMWithConfig(Config{DSN: "root@/orm_test?parseTime=true&loc=Local", Logger: logger})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer o.Close()
+
+		user := &TestOrmTrackedUser{UserName: "a"}
+		if err := o.Insert(user); err != nil {
+			t.Fatal(err)
+		}
+		//插入之后没有修改，不会执行sql
+		logger.sqls = nil
+		if err := o.UpdateChanged(user); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(logger.sqls), 0)
+
+		var loaded TestOrmTrackedUser
+		if err := o.SelectByPK(&loaded, user.ID); err != nil {
+			t.Fatal(err)
+		}
+		loaded.UserName = "b"
+		logger.sqls = nil
+		if err := o.UpdateChanged(&loaded); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(logger.sqls), 1)
+		assert.Equal(t, strings.HasPrefix(logger.sqls[0], "update test_orm_user set name = ? where id = ?"), true)
+		logger.sqls = nil
+		if err := o.UpdateChanged(&loaded); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(logger.sqls), 0)
+
+		var list []*TestOrmTrackedUser
+		if err := o.Select(&list, "select * from test_orm_user"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, list[0].UserName, "b")
+
+		//字段名和数据库字段名都按照db标签解析
+		loaded.UserName = "c"
+		if err := o.UpdateFieldsByPK(&loaded, []string{"UserName"}); err != nil {
+			t.Fatal(err)
+		}
+		loaded.UserName = "d"
+		if err := o.UpdateFieldsByPK(&loaded, []string{"name"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.SelectByPK(&loaded, user.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.UserName, "d")
+		if _, ok := o.UpdateFieldsByPK(&loaded, []string{"Unknown"}).(*MissingFieldError); !ok {
+			t.Fatal("should return MissingFieldError for unknown field")
+		}
+
+		//ignore标签的字段可以指定更新，关联字段不行
+		a := &TestOrmA123{Description: "ignore", StartDate: time.Now(), EndDate: time.Now()}
+		if err := o.Insert(a); err != nil {
+			t.Fatal(err)
+		}
+		a.UpdatedAt = time.Now().Add(time.Hour)
+		if err := o.UpdateFieldsByPK(a, []string{"updated_at"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := o.UpdateFieldsByPK(a, []string{"OrmB"}).(*MissingFieldError); !ok {
+			t.Fatal("should return MissingFieldError for relation field")
+		}
+
+		//没有嵌入DirtyTracker时返回error
+		if err := o.UpdateChanged(&TestOrmUser{}); err == nil {
+			t.Fatal("should require DirtyTracker")
+		}
+	})
+}
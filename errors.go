@@ -0,0 +1,87 @@
+package orm
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// ErrRecordNotFound 查询不到记录时返回，和sql.ErrNoRows是同一个值，原有的err == sql.ErrNoRows判断仍然有效
+var ErrRecordNotFound = sql.ErrNoRows
+
+// ErrNoPrimaryKey struct没有定义主键，返回时会带上表名，需要用errors.Is判断
+var ErrNoPrimaryKey = errors.New("does not have primary key")
+
+// ErrStaleObject 使用version标签的乐观锁更新时，记录已经被其他人修改或者删除，返回时会带上表名，需要用errors.Is判断
+var ErrStaleObject = errors.New("stale object, record has been modified or deleted")
+
+// ErrTransactionExists 使用PropagationNever时context中已经有事务
+var ErrTransactionExists = errors.New("transaction already exists in context")
+
+// RowAffectError 影响的行数和预期不一致
+type RowAffectError struct {
+	Expected int64
+	Actual   int64
+	Query    string
+}
+
+func (e *RowAffectError) Error() string {
+	return fmt.Sprintf("[RowAffectCheckError]: query [%s] should only affect %d rows, really affect %d rows", e.Query, e.Expected, e.Actual)
+}
+
+// MissingFieldError 数据库字段或者参数在struct、map中找不到对应的field
+type MissingFieldError struct {
+	Table string
+	Field string
+}
+
+func (e *MissingFieldError) Error() string {
+	if e.Table == "" {
+		return "missing field " + e.Field
+	}
+	return e.Table + " missing field " + e.Field
+}
+
+// RelationError or标签定义的关联关系不正确
+type RelationError struct {
+	Field   string
+	Message string
+}
+
+func (e *RelationError) Error() string {
+	return e.Message
+}
+
+func IsRowAffectError(err error) bool {
+	var e *RowAffectError
+	return errors.As(err, &e)
+}
+
+// MySQL的错误码，参考 https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
+const (
+	mysqlErrDuplicateEntry  = 1062
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+)
+
+func isMySQLError(err error, number uint16) bool {
+	var e *mysql.MySQLError
+	return errors.As(err, &e) && e.Number == number
+}
+
+// IsDuplicateKeyError 违反了主键或者唯一索引
+func IsDuplicateKeyError(err error) bool {
+	return isMySQLError(err, mysqlErrDuplicateEntry)
+}
+
+// IsDeadlockError 事务发生死锁被回滚，可以重试整个事务
+func IsDeadlockError(err error) bool {
+	return isMySQLError(err, mysqlErrDeadlock)
+}
+
+// IsLockWaitTimeoutError 等待行锁超时
+func IsLockWaitTimeoutError(err error) bool {
+	return isMySQLError(err, mysqlErrLockWaitTimeout)
+}
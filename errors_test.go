@@ -0,0 +1,59 @@
+package orm
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/magiconair/properties/assert"
+)
+
+type testNoPkModel struct {
+	Name string
+}
+
+func TestTypedErrors(t *testing.T) {
+	o := &ORM{}
+	err := o.DeleteByPK(&testNoPkModel{})
+	assert.Equal(t, errors.Is(err, ErrNoPrimaryKey), true)
+	assert.Equal(t, err.Error(), "test_no_pk_model does not have primary key")
+
+	_, err = getFieldValue(map[string]interface{}{}, "Name")
+	var mfe *MissingFieldError
+	assert.Equal(t, errors.As(err, &mfe), true)
+	assert.Equal(t, mfe.Field, "Name")
+
+	err = fmt.Errorf("wrapped: %w", &RowAffectError{Expected: 1, Actual: 0, Query: "delete"})
+	assert.Equal(t, IsRowAffectError(err), true)
+	assert.Equal(t, IsRowAffectError(errors.New("other")), false)
+	assert.Equal(t, errors.Is(ErrRecordNotFound, sql.ErrNoRows), true)
+
+	assert.Equal(t, IsDuplicateKeyError(fmt.Errorf("insert: %w", &mysql.MySQLError{Number: 1062})), true)
+	assert.Equal(t, IsDeadlockError(&mysql.MySQLError{Number: 1213}), true)
+	assert.Equal(t, IsLockWaitTimeoutError(&mysql.MySQLError{Number: 1205}), true)
+	assert.Equal(t, IsDeadlockError(&mysql.MySQLError{Number: 1062}), false)
+	assert.Equal(t, IsDuplicateKeyError(nil), false)
+}
+
+func TestMySQLErrors(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		obj := &TestOrmB999{NoAiId: 1, Description: "dup"}
+		if err := orm.Insert(obj); err != nil {
+			t.Fatal(err)
+		}
+		err := orm.Insert(obj)
+		assert.Equal(t, IsDuplicateKeyError(err), true)
+
+		err = orm.DeleteByPKWithRowAffectCheck(&TestOrmB999{NoAiId: 2})
+		var rae *RowAffectError
+		assert.Equal(t, errors.As(err, &rae), true)
+		assert.Equal(t, rae.Expected, int64(1))
+		assert.Equal(t, rae.Actual, int64(0))
+
+		var res TestOrmB999
+		err = orm.SelectByPK(&res, 2)
+		assert.Equal(t, errors.Is(err, ErrRecordNotFound), true)
+	})
+}
@@ -78,13 +78,14 @@ func generateModel(dbName, shortTName, tName string, schema drivers.TableSchema,
 	}()
 
 	model := ModelMeta{
-		Name:      toCapitalCase(shortTName, true),
-		LowerName: toCapitalCase(shortTName, false),
-		DbName:    dbName,
-		TableName: tName,
-		Fields:    make([]ModelField, len(schema)),
-		Uniques:   make([]ModelField, 0, len(schema)),
-		config:    config,
+		Name:          toCapitalCase(shortTName, true),
+		LowerName:     toCapitalCase(shortTName, false),
+		DbName:        dbName,
+		TableName:     tName,
+		Fields:        make([]ModelField, len(schema)),
+		Uniques:       make([]ModelField, 0, len(schema)),
+		PrimaryFields: make(PrimaryFields, 0, 1),
+		config:        config,
 	}
 	needTime := false
 	for i, col := range schema {
@@ -116,10 +117,11 @@ func generateModel(dbName, shortTName, tName string, schema drivers.TableSchema,
 		tagArr = append(tagArr, jsonTag)
 		if field.IsPrimaryKey {
 			tagArr = append(tagArr, "pk:\"true\"")
-			if model.PrimaryField != nil {
-				return fmt.Errorf("must not have more than one primary keys, %+v", field)
+			//联合主键时按照表中字段的顺序记录所有主键，PrimaryField保留第一个以兼容自定义模板
+			if model.PrimaryField == nil {
+				model.PrimaryField = &field
 			}
-			model.PrimaryField = &field
+			model.PrimaryFields = append(model.PrimaryFields, &field)
 			if field.IsAutoIncrement {
 				dbTag = fmt.Sprintf("db:\"%s,ai,pk\"", col.ColumnName)
 				tagArr = append(tagArr, "ai:\"true\"")
@@ -130,8 +132,12 @@ func generateModel(dbName, shortTName, tName string, schema drivers.TableSchema,
 			dbTag = fmt.Sprintf("db:\"%s\"", col.ColumnName)
 		}
 
-		if col.ColumnName == "created_at" || col.ColumnName == "updated_at" {
-			tagArr = append(tagArr, "ignore:\"true\"")
+		//创建和更新时间由orm自动设置，查询时仍然会读取
+		if col.ColumnName == "created_at" {
+			tagArr = append(tagArr, "autoCreateTime:\"true\"")
+		}
+		if col.ColumnName == "updated_at" {
+			tagArr = append(tagArr, "autoUpdateTime:\"true\"")
 		}
 		if len(tagArr) > 0 {
 			tagArr = append(tagArr, dbTag)
@@ -143,6 +149,9 @@ func generateModel(dbName, shortTName, tName string, schema drivers.TableSchema,
 
 		model.Fields[i] = field
 	}
+	if len(model.PrimaryFields) == 0 {
+		return fmt.Errorf("must have at least one primary key")
+	}
 
 	if err := model.GenHeader(w, tmpl, needTime); err != nil {
 		return fmt.Errorf("[%s] Fail to gen model header, %s", tName, err)
@@ -263,15 +272,43 @@ func (pf PrimaryFields) FormatFilters() func(string) string {
 	}
 }
 
+// 生成主键参数列表，例如 userId int64, roleId int64
+func (pf PrimaryFields) FormatParams() string {
+	params := make([]string, len(pf))
+	for i, field := range pf {
+		params[i] = fmt.Sprintf("%s %s", toCapitalCase(field.ColumnName, false), field.Type)
+	}
+	return strings.Join(params, ", ")
+}
+
+// 生成主键的参数调用，例如 userId, roleId
+func (pf PrimaryFields) FormatArgs() string {
+	args := make([]string, len(pf))
+	for i, field := range pf {
+		args[i] = toCapitalCase(field.ColumnName, false)
+	}
+	return strings.Join(args, ", ")
+}
+
+// 生成对象主键字段的调用，例如 obj.UserId, obj.RoleId
+func (pf PrimaryFields) FormatFieldArgs(obj string) string {
+	args := make([]string, len(pf))
+	for i, field := range pf {
+		args[i] = fmt.Sprintf("%s.%s", obj, field.Name)
+	}
+	return strings.Join(args, ", ")
+}
+
 type ModelMeta struct {
-	Name         string
-	LowerName    string
-	DbName       string
-	TableName    string
-	PrimaryField *ModelField
-	Fields       []ModelField
-	Uniques      []ModelField
-	config       CodeConfig
+	Name          string
+	LowerName     string
+	DbName        string
+	TableName     string
+	PrimaryField  *ModelField
+	PrimaryFields PrimaryFields
+	Fields        []ModelField
+	Uniques       []ModelField
+	config        CodeConfig
 }
 
 func (m ModelMeta) AllFields() string {
@@ -56,9 +56,9 @@ func (m *Model) Save{{.Name}}({{.LowerName}} *{{.Name}}) error {
 	return m.Master().InsertOrUpdate({{.LowerName}}, fields)
 }
 
-func (m *Model) Get{{.Name}}ByPK(id {{.PrimaryField.Type}}) (*{{.Name}}, error) {
+func (m *Model) Get{{.Name}}ByPK({{.PrimaryFields.FormatParams}}) (*{{.Name}}, error) {
 	var {{.LowerName}} {{.Name}}
-	err := m.SelectByPK(&{{.LowerName}}, id)
+	err := m.SelectByPK(&{{.LowerName}}, {{.PrimaryFields.FormatArgs}})
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err == nil {
@@ -90,7 +90,7 @@ func TestInsertAndGet{{.Name}}(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to Insert{{.Name}}, err: %+v", err)
 		}
-		loaded, err := m.Get{{.Name}}ByPK({{.LowerName}}.{{.PrimaryField.Name}})
+		loaded, err := m.Get{{.Name}}ByPK({{.PrimaryFields.FormatFieldArgs .LowerName}})
 		if err != nil {
 			t.Fatalf("failed to Get{{.Name}}ByPK, err: %+v", err)
 		}
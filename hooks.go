@@ -0,0 +1,97 @@
+package orm
+
+import (
+	"context"
+	"reflect"
+)
+
+// BeforeInserter 在Insert、InsertWithTable和InsertBatch执行insert之前调用，返回error时不会执行insert
+type BeforeInserter interface {
+	BeforeInsert(c context.Context, tdx Tdx) error
+}
+
+// AfterInserter 在insert成功并且自增主键赋值之后调用
+type AfterInserter interface {
+	AfterInsert(c context.Context, tdx Tdx) error
+}
+
+// BeforeUpdater 在UpdateByPK和UpdateFieldsByPK执行update之前调用，返回error时不会执行update
+type BeforeUpdater interface {
+	BeforeUpdate(c context.Context, tdx Tdx) error
+}
+
+// AfterUpdater 在update成功之后调用
+type AfterUpdater interface {
+	AfterUpdate(c context.Context, tdx Tdx) error
+}
+
+// BeforeDeleter 在DeleteByPK执行delete之前调用，返回error时不会执行delete
+type BeforeDeleter interface {
+	BeforeDelete(c context.Context, tdx Tdx) error
+}
+
+// AfterFinder 查询到的struct赋值完成之后调用，此时关联已经加载完成，关联的struct也会调用
+type AfterFinder interface {
+	AfterFind(c context.Context, tdx Tdx) error
+}
+
+var afterFinderType = reflect.TypeOf((*AfterFinder)(nil)).Elem()
+
+// hook都定义在指针上，s需要是struct的指针
+func beforeInsert(c context.Context, tdx Tdx, s interface{}) error {
+	if h, ok := s.(BeforeInserter); ok {
+		return h.BeforeInsert(hookContext(c), tdx)
+	}
+	return nil
+}
+
+func afterInsert(c context.Context, tdx Tdx, s interface{}) error {
+	if h, ok := s.(AfterInserter); ok {
+		return h.AfterInsert(hookContext(c), tdx)
+	}
+	return nil
+}
+
+func beforeUpdate(c context.Context, tdx Tdx, s interface{}) error {
+	if h, ok := s.(BeforeUpdater); ok {
+		return h.BeforeUpdate(hookContext(c), tdx)
+	}
+	return nil
+}
+
+func afterUpdate(c context.Context, tdx Tdx, s interface{}) error {
+	if h, ok := s.(AfterUpdater); ok {
+		return h.AfterUpdate(hookContext(c), tdx)
+	}
+	return nil
+}
+
+func beforeDelete(c context.Context, tdx Tdx, s interface{}) error {
+	if h, ok := s.(BeforeDeleter); ok {
+		return h.BeforeDelete(hookContext(c), tdx)
+	}
+	return nil
+}
+
+// hook中执行的查询不使用调用方的Preload
+func hookContext(c context.Context) context.Context {
+	return withoutPreload(ensureContext(c))
+}
+
+// t为struct类型，*t实现了AfterFinder时需要在查询之后调用
+func hasAfterFind(t reflect.Type) bool {
+	return reflect.PtrTo(t).Implements(afterFinderType)
+}
+
+// 对查询到的struct指针调用AfterFind，需要在rows关闭之后调用，避免hook中执行sql时连接被占用
+func afterFind(c context.Context, tdx Tdx, t reflect.Type, values []reflect.Value) error {
+	if !hasAfterFind(t) {
+		return nil
+	}
+	for _, v := range values {
+		if err := v.Interface().(AfterFinder).AfterFind(hookContext(c), tdx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
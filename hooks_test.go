@@ -0,0 +1,126 @@
+package orm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+)
+
+type testHookModel struct {
+	TestOrmDId int64 `pk:"true" ai:"true"`
+	Name       string
+	Events     []string `ignore:"true"`
+}
+
+func (m *testHookModel) TableName() string {
+	return "test_orm_d222"
+}
+
+func (m *testHookModel) BeforeInsert(c context.Context, tdx Tdx) error {
+	if m.Name == "" {
+		return errors.New("name is required")
+	}
+	m.Name = strings.TrimSpace(m.Name)
+	m.Events = append(m.Events, "before insert")
+	return nil
+}
+
+func (m *testHookModel) AfterInsert(c context.Context, tdx Tdx) error {
+	//hook中使用同一个连接，事务中可以读到刚插入的数据
+	name, err := selectStr(c, tdx, "select name from test_orm_d222 where test_orm_d_id = ?", m.TestOrmDId)
+	if err != nil {
+		return err
+	}
+	m.Events = append(m.Events, "after insert "+name)
+	return nil
+}
+
+func (m *testHookModel) BeforeUpdate(c context.Context, tdx Tdx) error {
+	if m.Name == "invalid" {
+		return errors.New("invalid name")
+	}
+	m.Events = append(m.Events, "before update")
+	return nil
+}
+
+func (m *testHookModel) AfterUpdate(c context.Context, tdx Tdx) error {
+	m.Events = append(m.Events, "after update")
+	return nil
+}
+
+func (m *testHookModel) BeforeDelete(c context.Context, tdx Tdx) error {
+	if m.Name == "keep" {
+		return errors.New("can not delete")
+	}
+	return nil
+}
+
+func (m *testHookModel) AfterFind(c context.Context, tdx Tdx) error {
+	m.Events = append(m.Events, "after find")
+	return nil
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		m := &testHookModel{Name: "  hook  "}
+		if err := orm.Insert(m); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, m.Events, []string{"before insert", "after insert hook"})
+		if err := orm.Insert(&testHookModel{}); err == nil || err.Error() != "name is required" {
+			t.Fatal("BeforeInsert should abort insert", err)
+		}
+
+		m.Events = nil
+		m.Name = "updated"
+		if err := orm.UpdateByPK(m); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, m.Events, []string{"before update", "after update"})
+		m.Name = "invalid"
+		if err := orm.UpdateFieldsByPK(m, []string{"Name"}); err == nil {
+			t.Fatal("BeforeUpdate should abort update")
+		}
+
+		var loaded testHookModel
+		if err := orm.SelectByPK(&loaded, m.TestOrmDId); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.Name, "updated")
+		assert.Equal(t, loaded.Events, []string{"after find"})
+
+		list := []interface{}{&testHookModel{Name: "b1"}, &testHookModel{Name: "b2"}}
+		if err := orm.InsertBatch(list); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, list[1].(*testHookModel).Events, []string{"before insert", "after insert b2"})
+		var all []*testHookModel
+		if err := orm.Select(&all, "select * from test_orm_d222 order by test_orm_d_id"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(all), 3)
+		assert.Equal(t, all[2].Events, []string{"after find"})
+
+		loaded.Name = "keep"
+		if err := orm.DeleteByPK(&loaded); err == nil {
+			t.Fatal("BeforeDelete should abort delete")
+		}
+
+		//事务中Before hook返回error时整个事务回滚
+		err := orm.DoTransaction(func(ot *ORMTran) error {
+			if err := ot.Insert(&testHookModel{Name: "in tran"}); err != nil {
+				return err
+			}
+			return ot.Insert(&testHookModel{})
+		})
+		assert.Equal(t, err.Error(), "name is required")
+		cnt, err := orm.SelectInt("select count(*) from test_orm_d222")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cnt, int64(3))
+	})
+}
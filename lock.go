@@ -0,0 +1,66 @@
+package orm
+
+import (
+	"context"
+	"strings"
+)
+
+// 事务中查询时的锁定语句
+const (
+	LockForUpdate   = "FOR UPDATE"
+	LockInShareMode = "LOCK IN SHARE MODE"
+)
+
+type lockKey struct{}
+
+type lockOption struct {
+	clause    string
+	relations bool //关联记录是否也需要锁定
+}
+
+func withLock(c context.Context, clause string, relations bool) context.Context {
+	return context.WithValue(ensureContext(c), lockKey{}, &lockOption{clause: clause, relations: relations})
+}
+
+// 按照context中的锁定要求在sql最后加上锁定语句，limit会由addLimit加在锁定语句之前，relation表示是否为关联查询
+func lockSQL(c context.Context, sql string, relation bool) string {
+	if c == nil {
+		return sql
+	}
+	opt, ok := c.Value(lockKey{}).(*lockOption)
+	if !ok || (relation && !opt.relations) {
+		return sql
+	}
+	if lockClauseReg.MatchString(sql) {
+		return sql
+	}
+	return strings.TrimSuffix(strings.TrimSpace(sql), ";") + " " + opt.clause
+}
+
+// LockRelations 返回一个在SelectForUpdate、SelectOneForUpdate等加锁查询时，同时锁定加载的关联记录的ORMTran
+func (o *ORMTran) LockRelations() *ORMTran {
+	no := new(ORMTran)
+	*no = *o
+	no.lockRelations = true
+	return no
+}
+
+// SelectForUpdate 和Select一样，但是会通过FOR UPDATE锁定查询到的记录
+func (o *ORMTran) SelectForUpdate(s interface{}, query string, args ...interface{}) error {
+	return selectMany(withLock(o.ctx, LockForUpdate, o.lockRelations), o.tx, s, query, args...)
+}
+
+// SelectOneForUpdate 和SelectOne一样，但是会通过FOR UPDATE锁定查询到的记录
+func (o *ORMTran) SelectOneForUpdate(s interface{}, query string, args ...interface{}) error {
+	return selectOne(withLock(o.ctx, LockForUpdate, o.lockRelations), o.tx, s, query, args...)
+}
+
+// SelectInShareMode 和Select一样，但是会通过LOCK IN SHARE MODE对查询到的记录加共享锁
+func (o *ORMTran) SelectInShareMode(s interface{}, query string, args ...interface{}) error {
+	return selectMany(withLock(o.ctx, LockInShareMode, o.lockRelations), o.tx, s, query, args...)
+}
+
+// SelectOneInShareMode 和SelectOne一样，但是会通过LOCK IN SHARE MODE对查询到的记录加共享锁
+func (o *ORMTran) SelectOneInShareMode(s interface{}, query string, args ...interface{}) error {
+	return selectOne(withLock(o.ctx, LockInShareMode, o.lockRelations), o.tx, s, query, args...)
+}
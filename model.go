@@ -0,0 +1,269 @@
+package orm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// struct中的一个字段
+type modelField struct {
+	index    int
+	name     string
+	column   string
+	pk       bool
+	ai       bool
+	ignore   bool //ignore标签或者关联字段，不参与insert和update
+	virtual  bool //关联字段和DirtyTracker，数据库中没有对应的字段
+	isTime   bool
+	nullable bool //time.Time类型的软删除字段，零值写入NULL，查询到NULL时设置为零值
+}
+
+// struct类型的元数据，每个类型只解析一次，之后从modelMetas中获取
+type modelMeta struct {
+	typ         reflect.Type
+	fields      []*modelField
+	tagFields   map[string]int //db或者json标签中的字段名 -> field下标
+	pkFields    []string
+	pkCols      []string
+	pks         []*modelField
+	ai          *modelField
+	softDelete  *modelField   //softdelete标签的字段，删除时只设置删除时间
+	version     *modelField   //version标签的整数字段，用于乐观锁
+	versionErr  error         //version标签的字段不是整数
+	createTimes []*modelField //autoCreateTime标签的字段，insert时自动设置为当前时间
+	updateTimes []*modelField //autoUpdateTime标签的字段，insert和update时自动设置为当前时间
+	inserts     []*modelField //insert和update时使用的字段，不包含自增主键和ignore字段
+	insertSQL   string        //inserts对应的字段列表，例如 a,b,c
+	relations   []*orColumn
+	relErr      error
+	scanIdxes   sync.Map //查询结果的字段列表 -> 每个字段在struct中的index
+}
+
+var modelMetas sync.Map
+
+// 获取struct类型的元数据，t不能是指针
+func getModelMeta(t reflect.Type) *modelMeta {
+	if m, ok := modelMetas.Load(t); ok {
+		return m.(*modelMeta)
+	}
+	m, _ := modelMetas.LoadOrStore(t, newModelMeta(t))
+	return m.(*modelMeta)
+}
+
+func newModelMeta(t reflect.Type) *modelMeta {
+	m := &modelMeta{
+		typ:       t,
+		tagFields: make(map[string]int, t.NumField()),
+	}
+	cols := make([]string, 0, t.NumField())
+	for k := 0; k < t.NumField(); k++ {
+		ft := t.Field(k)
+		f := &modelField{
+			index:   k,
+			name:    ft.Name,
+			column:  getFieldColName(ft),
+			pk:      isPkField(ft),
+			ai:      isAiField(ft),
+			ignore:  ft.Tag.Get("ignore") == "true" || ft.Tag.Get("or") != "" || ft.Type == dirtyTrackerType,
+			virtual: ft.Tag.Get("or") != "" || ft.Type == dirtyTrackerType,
+			isTime:  ft.Type == timeType,
+		}
+		m.fields = append(m.fields, f)
+		//获取struct中的db标签组成字典，查询时字典中存在的字段优先匹配，db标签为空时兼容json标签
+		if dbCol := getDbTagCol(ft.Tag.Get("db")); dbCol != "" {
+			m.tagFields[dbCol] = k
+		} else if jsonTag := ft.Tag.Get("json"); jsonTag != "" {
+			m.tagFields[strings.Split(jsonTag, ",")[0]] = k
+		}
+		if ft.Tag.Get("softdelete") == "true" {
+			m.softDelete = f
+			f.nullable = f.isTime
+		}
+		if ft.Tag.Get("version") == "true" {
+			if isVersionKind(ft.Type.Kind()) {
+				m.version = f
+			} else {
+				m.versionErr = fmt.Errorf("%s.%s version field should be an integer, got %s", t.Name(), ft.Name, ft.Type)
+			}
+		}
+		//老的生成代码中created_at和updated_at带有ignore标签，有autoCreateTime或者autoUpdateTime标签时仍然写入
+		autoCreate := !f.virtual && ft.Tag.Get("autoCreateTime") == "true"
+		autoUpdate := !f.virtual && ft.Tag.Get("autoUpdateTime") == "true"
+		if autoCreate || autoUpdate {
+			f.ignore = false
+		}
+		if autoCreate {
+			m.createTimes = append(m.createTimes, f)
+		}
+		if autoUpdate {
+			m.updateTimes = append(m.updateTimes, f)
+		}
+		if f.pk {
+			m.pkFields = append(m.pkFields, f.name)
+			m.pkCols = append(m.pkCols, f.column)
+			m.pks = append(m.pks, f)
+			if f.ai {
+				m.ai = f
+				continue
+			}
+		}
+		if f.ignore {
+			continue
+		}
+		m.inserts = append(m.inserts, f)
+		cols = append(cols, f.column)
+	}
+	m.insertSQL = strings.Join(cols, ",")
+	m.relations, m.relErr = parseOrColumns(t)
+	if m.relErr == nil && len(m.relations) > 0 && len(m.pkFields) == 0 {
+		m.relErr = fmt.Errorf("%s %w for relations", t.Name(), ErrNoPrimaryKey)
+	}
+	return m
+}
+
+// 查询结果中每个字段在struct中的index，没有对应字段时为nil，同样的字段列表只计算一次
+func (m *modelMeta) scanIndexes(cols []string) [][]int {
+	key := strings.Join(cols, ",")
+	if idxes, ok := m.scanIdxes.Load(key); ok {
+		return idxes.([][]int)
+	}
+	idxes := make([][]int, len(cols))
+	for k, c := range cols {
+		if i, ok := m.tagFields[c]; ok { //先进行字典匹配
+			idxes[k] = []int{i}
+		} else if sf, ok := m.typ.FieldByName(colName2FieldName(c)); ok {
+			idxes[k] = sf.Index
+		} else {
+			logrus.WithField("type", m.typ.String()).Warnf("missing field: %s", c)
+		}
+	}
+	m.scanIdxes.Store(key, idxes)
+	return idxes
+}
+
+// 数据库字段对应的field的名字，优先db和json标签，找不到时通过驼峰转换
+func (m *modelMeta) fieldNames(cols []string) []string {
+	ret := make([]string, len(cols))
+	for k, c := range cols {
+		if i, ok := m.tagFields[c]; ok {
+			ret[k] = m.fields[i].name
+		} else {
+			ret[k] = colName2FieldName(c)
+		}
+	}
+	return ret
+}
+
+// 通过struct中的字段名或者数据库字段名找到字段，数据库字段名按照db和json标签匹配，找不到时按照驼峰转换
+func (m *modelMeta) lookupField(name string) *modelField {
+	if i, ok := m.tagFields[name]; ok {
+		return m.fields[i]
+	}
+	for _, f := range m.fields {
+		if f.name == name || f.column == name {
+			return f
+		}
+	}
+	if sf, ok := m.typ.FieldByName(colName2FieldName(name)); ok && len(sf.Index) == 1 {
+		return m.fields[sf.Index[0]]
+	}
+	return nil
+}
+
+// 按照scanIndexes的结果获取Scan的目标，没有对应字段的值会被丢弃
+func (m *modelMeta) scanTargets(v reflect.Value, idxes [][]int) []interface{} {
+	targets := make([]interface{}, len(idxes))
+	for k, idx := range idxes {
+		if idx == nil {
+			var b interface{}
+			targets[k] = &b
+		} else if len(idx) == 1 && m.fields[idx[0]].nullable {
+			targets[k] = nullZeroTime{v.Field(idx[0]).Addr().Interface().(*time.Time)}
+		} else {
+			targets[k] = v.FieldByIndex(idx).Addr().Interface()
+		}
+	}
+	return targets
+}
+
+// insert和update时的参数，零值的time.Time替换为zeroTime，软删除字段替换为NULL
+func fieldArg(v reflect.Value, f *modelField) interface{} {
+	fv := v.Field(f.index)
+	if f.isTime && fv.Interface().(time.Time).IsZero() {
+		if f.nullable {
+			return nil
+		}
+		return &zeroTime
+	}
+	return fv.Addr().Interface()
+}
+
+// 根据struct中的值找到其他struct进行relation的联系，并组成[]*orColumn结构
+func parseOrColumns(t reflect.Type) ([]*orColumn, error) {
+	res := make([]*orColumn, 0)
+	// TODO: error check, i.e., has_one field must be a pointer of registered model
+	for k := 0; k < t.NumField(); k++ {
+		ft := t.Field(k)
+		orTag := ft.Tag.Get("or")
+		if orTag != "" {
+			if orTag == "has_one" || orTag == "has_many" || orTag == "belongs_to" || orTag == "many_to_many" {
+				var orType reflect.Type
+				if orTag == "has_one" {
+					if ft.Type.Kind() != reflect.Ptr {
+						return res, &RelationError{Field: ft.Name, Message: ft.Name + " should be pointer"}
+					}
+					orType = ft.Type.Elem()
+				} else if orTag == "has_many" || orTag == "many_to_many" {
+					if ft.Type.Kind() != reflect.Slice {
+						return res, &RelationError{Field: ft.Name, Message: ft.Name + " should be slice of pointer"}
+					}
+					elemType := ft.Type.Elem()
+					if elemType.Kind() != reflect.Ptr {
+						return res, &RelationError{Field: ft.Name, Message: ft.Name + " should be slice of pointer"}
+					}
+					orType = elemType.Elem()
+				} else if orTag == "belongs_to" {
+					if ft.Type.Kind() != reflect.Ptr {
+						return res, &RelationError{Field: ft.Name, Message: ft.Name + " should be pointer"}
+					}
+					orType = ft.Type.Elem()
+				}
+				orTableName := ft.Tag.Get("table")
+				if orTableName == "" {
+					return res, &RelationError{Field: ft.Name, Message: "invalid table name in or tag on field: " + ft.Name}
+				}
+				orCol := &orColumn{
+					fieldName: ft.Name,
+					or:        orTag,
+					table:     orTableName,
+					orType:    orType,
+				}
+				if fk := ft.Tag.Get("fk"); fk != "" {
+					orCol.fks = strings.Split(fk, ",")
+				}
+				if ref := ft.Tag.Get("ref"); ref != "" {
+					orCol.refs = strings.Split(ref, ",")
+				}
+				if orTag == "many_to_many" {
+					orCol.joinTable = ft.Tag.Get("join_table")
+					if orCol.joinTable == "" {
+						return res, &RelationError{Field: ft.Name, Message: "invalid join_table in or tag on field: " + ft.Name}
+					}
+					orCol.joinFk = ft.Tag.Get("join_fk")
+					orCol.joinRef = ft.Tag.Get("join_ref")
+				}
+				res = append(res, orCol)
+			} else {
+				return res, &RelationError{Field: ft.Name, Message: "unsupported or tag: " + orTag + ", only support has_one, has_many, belongs_to and many_to_many for now"}
+			}
+		}
+	}
+	return res, nil
+}
@@ -7,9 +7,11 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -30,6 +32,18 @@ func SetLog(sqlLog SqlLogger) {
 	sqlLogger = sqlLog
 }
 
+type loggerKey struct{}
+
+// 获取context中的logger，没有时使用SetLog设置的全局logger
+func getLogger(c context.Context) SqlLogger {
+	if c != nil {
+		if logger, ok := c.Value(loggerKey{}).(SqlLogger); ok {
+			return logger
+		}
+	}
+	return sqlLogger
+}
+
 /**
 把数据库中的字段(可以处理带下划线的字段)转化为struct中的字段，首字母大写和驼峰
 */
@@ -60,25 +74,6 @@ func fieldName2ColName(buf string) string {
 	return w.String()
 }
 
-//获取db标签中的内容，如果db标签为空，对json标签进行兼容
-func getDbTagMap(t reflect.Type, n int) map[string]string {
-	dbTags := make(map[string]string, n)
-	for k := 0; k < t.NumField(); k++ {
-		ft := t.Field(k)
-		dbTag := ft.Tag.Get("db")
-		dbCol := getDbTagCol(dbTag)
-		if dbCol != "" { //获取struct中的db标签组成字典，在后面更新中，只要字典存在的值，就进行替换
-			dbTags[dbCol] = ft.Name
-		} else {
-			jsonTag := ft.Tag.Get("json")
-			if jsonTag != "" {
-				dbTags[strings.Split(jsonTag, ",")[0]] = ft.Name
-			}
-		}
-	}
-	return dbTags
-}
-
 /*
  通过reflect把row中的值映射到一个struct中
 */
@@ -91,28 +86,9 @@ func reflectStructValue(v reflect.Value, t reflect.Type, cols []string, row *sql
 	if v.Kind() != reflect.Ptr {
 		return errors.New("holder should be pointer")
 	}
-	v = v.Elem()
-	targets := make([]interface{}, len(cols))
-	//修改映射关系,建立db的对应关系
-	dbTags := getDbTagMap(t, len(cols))
-
-	for k, c := range cols {
-		col := ""
-		if temp, ok := dbTags[c]; ok { //先进行字典匹配
-			col = temp
-		} else {
-			col = colName2FieldName(c)
-		}
-		fv := v.FieldByName(col)
-		if !fv.CanAddr() {
-			logrus.Infof("missing filed :%s", c)
-			var b interface{}
-			targets[k] = &b
-		} else {
-			targets[k] = fv.Addr().Interface()
-		}
-	}
-	return row.Scan(targets...)
+	//字段的映射关系从缓存的元数据中获取
+	m := getModelMeta(t)
+	return row.Scan(m.scanTargets(v.Elem(), m.scanIndexes(cols))...)
 }
 
 func checkStruct(s interface{}, cols []string, tableName string) error {
@@ -125,20 +101,29 @@ func checkStruct(s interface{}, cols []string, tableName string) error {
 	for _, c := range cols {
 		_, ok := v.FieldByName(colName2FieldName(c))
 		if !ok {
-			return errors.New(tableName + " missing field " + c)
+			return &MissingFieldError{Table: tableName, Field: c}
 		}
 	}
 	return nil
 }
 
+// 数据库操作的抽象，*sql.DB和*sql.Tx都实现了该接口，所有操作都会带上context，以便超时和取消可以中断正在执行的sql
 type Tdx interface {
-	Exec(string, ...interface{}) (sql.Result, error)
-	Query(string, ...interface{}) (*sql.Rows, error)
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
 }
 
-func getColumns(tdx Tdx, tableName string) ([]string, error) {
+// ORM没有设置context时，使用context.Background()
+func ensureContext(c context.Context) context.Context {
+	if c == nil {
+		return context.Background()
+	}
+	return c
+}
+
+func getColumns(c context.Context, tdx Tdx, tableName string) ([]string, error) {
 	ret := []string{}
-	rows, err := tdx.Query("show columns from " + tableName)
+	rows, err := tdx.QueryContext(ensureContext(c), "show columns from "+tableName)
 	if err != nil {
 		return ret, err
 	}
@@ -156,9 +141,9 @@ func getColumns(tdx Tdx, tableName string) ([]string, error) {
 	return ret, nil
 }
 
-func checkTableColumns(tdx Tdx, s interface{}) error {
+func checkTableColumns(c context.Context, tdx Tdx, s interface{}) error {
 	tableName := getTableName(s)
-	cols, err := getColumns(tdx, tableName)
+	cols, err := getColumns(c, tdx, tableName)
 	if err != nil {
 		return err
 	}
@@ -170,6 +155,8 @@ type SqlLog struct {
 	Sql      string        `json:"sql"`
 	Duration time.Duration `json:"duration"`
 	Explain  []*Explain    `json:"explain,omitempty"`
+	Attempt  int           `json:"attempt,omitempty"` //DoTransactionWithRetry中失败的第几次执行
+	Error    string        `json:"error,omitempty"`
 }
 type Explain struct {
 	Table  string `json:"table,omitempty"`
@@ -195,6 +182,12 @@ func (n *VerboseSqlLogger) Log(c context.Context, sqlLog *SqlLog) {
 		data, _ := json.Marshal(sqlLog.Explain)
 		logs = logs.WithField("Explain", string(data))
 	}
+	if sqlLog.Attempt > 0 {
+		logs = logs.WithField("Attempt", sqlLog.Attempt)
+	}
+	if sqlLog.Error != "" {
+		logs = logs.WithField("Error", sqlLog.Error)
+	}
 	logs.Info()
 }
 
@@ -206,6 +199,10 @@ func logPrint(c context.Context, logger SqlLogger, exp []*Explain, duration time
 	queryStr = regexp.MustCompile("\\s+").ReplaceAllString(queryStr, " ")
 	newArgs := make([]interface{}, 0)
 	for _, arg := range args {
+		if arg == nil { //NULL参数，例如time.Time类型的软删除字段
+			newArgs = append(newArgs, arg)
+			continue
+		}
 		t := reflect.TypeOf(arg)
 		switch t.Kind() {
 		case reflect.Ptr:
@@ -222,7 +219,7 @@ func logPrint(c context.Context, logger SqlLogger, exp []*Explain, duration time
 	sqlLog := SqlLog{Duration: duration, Sql: fmt.Sprintf("%s%+v", queryStr, newArgs), Explain: exp}
 	logger.Log(c, &sqlLog)
 }
-func doExplain(tdx Tdx, query string, args ...interface{}) ([]*Explain, error) {
+func doExplain(c context.Context, tdx Tdx, query string, args ...interface{}) ([]*Explain, error) {
 	explainStr := fmt.Sprintf("explain %s", query)
 	type explain struct {
 		Id           sql.NullInt64  `json:"id"`
@@ -238,7 +235,7 @@ func doExplain(tdx Tdx, query string, args ...interface{}) ([]*Explain, error) {
 		Rows         sql.NullInt64  `json:"rows"`
 		Extra        sql.NullString `json:"extra"`
 	}
-	rows, err := tdx.Query(explainStr, args...)
+	rows, err := tdx.QueryContext(ensureContext(c), explainStr, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -253,36 +250,42 @@ func doExplain(tdx Tdx, query string, args ...interface{}) ([]*Explain, error) {
 		}
 		exp = append(exp, &Explain{Table: e.Table.String, KeyLen: e.KeyLen.Int64, Type: e.Type.String, Key: e.Key.String, Ref: e.Ref.String, Rows: e.Rows.Int64, Extra: e.Extra.String})
 	}
-	return exp, nil
+	return exp, rows.Err()
 }
 func exec(c context.Context, tdx Tdx, query string, args ...interface{}) (sql.Result, error) {
 	start := time.Now()
 	query, args = changeSQLIn(query, args...)
-	res, err := tdx.Exec(query, args...)
+	res, err := tdx.ExecContext(ensureContext(c), query, args...)
 	if err != nil { //更换处理方式，如果是err就直接打印err日志，不打印其他日志，不用多执行一遍exec
 		return res, err
 	}
-	logPrint(c, sqlLogger, nil, time.Since(start), query, args...)
+	logPrint(c, getLogger(c), nil, time.Since(start), query, args...)
 	return res, err
 }
 
-func query(c context.Context, tdx Tdx, queryStr string, args ...interface{}) (res *sql.Rows, err error) {
-	queryStr = addLimit(queryStr, 0)
+func query(c context.Context, tdx Tdx, queryStr string, args ...interface{}) (*sql.Rows, error) {
+	return queryWithoutLimit(c, tdx, addLimit(queryStr, 0), args...)
+}
+
+// 和query一样但是不会自动加limit，用于关联的批量查询，结果的行数由keys的数量决定
+func queryWithoutLimit(c context.Context, tdx Tdx, queryStr string, args ...interface{}) (res *sql.Rows, err error) {
 	queryStr, args = changeSQLIn(queryStr, args...)
 	start := time.Now()
-	if res, err = tdx.Query(queryStr, args...); err != nil {
+	if res, err = tdx.QueryContext(ensureContext(c), queryStr, args...); err != nil {
 		return res, err
 	}
 	duration := time.Since(start)
 
 	var exp []*Explain
-	if sqlLogger.ShowExplain(duration) {
-		exp, err = doExplain(tdx, queryStr, args...)
+	logger := getLogger(c)
+	if logger.ShowExplain(duration) {
+		exp, err = doExplain(c, tdx, queryStr, args...)
 		if err != nil {
+			res.Close()
 			return nil, err
 		}
 	}
-	logPrint(c, sqlLogger, exp, duration, queryStr, args...)
+	logPrint(c, logger, exp, duration, queryStr, args...)
 	return res, nil
 }
 
@@ -315,36 +318,132 @@ func execWithRowAffectCheck(c context.Context, tdx Tdx, expectRows int64, query
 		return err
 	}
 	if ra != expectRows {
-		return errors.New(fmt.Sprintf("[RowAffectCheckError]: query [%s] should only affect %d rows, really affect %d rows", query, expectRows, ra))
+		return &RowAffectError{Expected: expectRows, Actual: ra, Query: query}
 	}
 	return nil
 }
 
-func getPKColumn(s interface{}) string {
-	t := reflect.TypeOf(s).Elem()
-	return getPkColumnByType(t)
-}
-
-//获取标签为pk的col
-func getPkColumnByType(t reflect.Type) string {
-	for k := 0; k < t.NumField(); k++ {
-		ft := t.Field(k)
-		dbTag := ft.Tag.Get("db")
-		dbCol := getDbTagCol(dbTag)
-		if dbCol == "" { //兼容json标签
-			jsonTag := ft.Tag.Get("json")
-			if jsonTag != "" {
-				dbCol = strings.Split(jsonTag, ",")[0]
-			}
+// 获取field对应的数据库字段，优先db标签，其次json标签，最后通过驼峰转换
+func getFieldColName(ft reflect.StructField) string {
+	dbCol := getDbTagCol(ft.Tag.Get("db"))
+	if dbCol == "" { //兼容json标签
+		dbCol = strings.Split(ft.Tag.Get("json"), ",")[0]
+	}
+	if dbCol == "" {
+		dbCol = fieldName2ColName(ft.Name)
+	}
+	return dbCol
+}
+
+func isPkField(ft reflect.StructField) bool {
+	return ft.Tag.Get("pk") == "true" || isPkOrAi(ft.Tag.Get("db"), "pk")
+}
+
+func isAiField(ft reflect.StructField) bool {
+	return ft.Tag.Get("ai") == "true" || isPkOrAi(ft.Tag.Get("db"), "ai")
+}
+
+// 获取标签为pk的field的名字和对应的col，联合主键时按照struct中定义的顺序返回多个
+func getPkColumnsByType(t reflect.Type) ([]string, []string) {
+	m := getModelMeta(t)
+	return m.pkFields, m.pkCols
+}
+
+// 主键的where条件，例如 a = ? and b = ?
+func pkWhereSQL(pkCols []string) string {
+	cs := make([]string, len(pkCols))
+	for i, col := range pkCols {
+		cs[i] = col + " = ?"
+	}
+	return strings.Join(cs, " and ")
+}
+
+// 批量查询时的in条件，单个字段时为 a in (?,?)，多个字段时为 (a,b) in ((?,?),(?,?))
+func inSQL(cols []string, keys [][]interface{}) (string, []interface{}) {
+	args := make([]interface{}, 0, len(keys)*len(cols))
+	holders := make([]string, len(keys))
+	for i, key := range keys {
+		holders[i] = placeholders(len(key))
+		if len(cols) > 1 {
+			holders[i] = "(" + holders[i] + ")"
 		}
-		if ft.Tag.Get("pk") == "true" || isPkOrAi(dbTag, "pk") {
-			if dbCol != "" {
-				return dbCol
-			}
-			return fieldName2ColName(ft.Name)
+		args = append(args, key...)
+	}
+	if len(cols) == 1 {
+		return cols[0] + " in (" + strings.Join(holders, ",") + ")", args
+	}
+	return "(" + strings.Join(cols, ",") + ") in (" + strings.Join(holders, ",") + ")", args
+}
+
+// 关联查询时作为map的key，单主键时直接使用主键的值，联合主键时把多个值拼接为字符串
+func relationKey(values []interface{}) interface{} {
+	if len(values) == 1 {
+		return normalizeKey(values[0])
+	}
+	keys := make([]interface{}, len(values))
+	for i, v := range values {
+		keys[i] = normalizeKey(v)
+	}
+	return fmt.Sprintf("%#v", keys)
+}
+
+// 把主键的值转换为可以作为map key并且可以比较的值，父子表中字段类型不同(例如int64和uint64)时也能匹配上，
+// []byte转换为string，time.Time转换为纳秒，实现了driver.Valuer的类型使用Value()的结果
+func normalizeKey(key interface{}) interface{} {
+	if valuer, ok := key.(driver.Valuer); ok {
+		if value, err := valuer.Value(); err == nil {
+			key = value
+		}
+	}
+	switch k := key.(type) {
+	case []byte:
+		return string(k)
+	case time.Time:
+		//同一时刻在不同时区或者带有单调时钟时==不相等，统一转换为纳秒
+		return timeKey(k.UnixNano())
+	}
+	v := reflect.ValueOf(key)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() <= math.MaxInt64 {
+			return int64(v.Uint())
+		}
+		return v.Uint()
+	case reflect.String:
+		return v.String()
+	}
+	return key
+}
+
+// 时间类型的主键转换后的key，和整数类型的主键区分开
+type timeKey int64
+
+// 把自增id赋值给主键，支持有符号和无符号的整数类型
+func setAutoIncrementValue(v reflect.Value, id int64) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(id)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(id))
+	default:
+		return errors.New("auto increment primary key should be integer, but got " + v.Type().String())
+	}
+	return nil
+}
+
+// 获取struct中多个field的值
+func getFieldValues(v reflect.Value, fields []string) ([]interface{}, bool) {
+	ret := make([]interface{}, len(fields))
+	for i, f := range fields {
+		fv := v.FieldByName(f)
+		if !fv.IsValid() {
+			return nil, false
 		}
+		ret[i] = fv.Interface()
 	}
-	return ""
+	return ret, true
 }
 
 type orColumn struct {
@@ -352,81 +451,22 @@ type orColumn struct {
 	or        string
 	table     string
 	orType    reflect.Type
-}
-
-/**
-返回三个值，一个是struct主键的field，一个是主键对应的数据库的值 ，一个是[]*orColumn
-*/
-func getOrColumns(s interface{}) (string, string, []*orColumn, error) {
-	t := reflect.TypeOf(s).Elem()
-	return getOrColumnsByType(t)
+	fks       []string //fk标签，has_one和has_many时为关联表的字段，belongs_to时为当前表的字段
+	refs      []string //ref标签，has_one和has_many时为当前表的字段，belongs_to时为关联表的字段
+	joinTable string   //many_to_many的中间表
+	joinFk    string   //中间表中关联当前表的字段
+	joinRef   string   //中间表中关联table的字段
 }
 
 /**
 根据struct中的值找到其他struct进行relation的联系，并组成[]*orColumn结构,返回三个值，一个是struct主键的field，一个是主键对应的数据库的值 ，一个是[]*orColumn
 */
-func getOrColumnsByType(t reflect.Type) (string, string, []*orColumn, error) {
-	res := make([]*orColumn, 0)
-	pkCol := ""
-	pkField := ""
-	// TODO: error check, i.e., has_one field must be a pointer of registered model
-	for k := 0; k < t.NumField(); k++ {
-		ft := t.Field(k)
-		orTag := ft.Tag.Get("or")
-		if orTag != "" {
-			if orTag == "has_one" || orTag == "has_many" || orTag == "belongs_to" {
-				var orType reflect.Type
-				if orTag == "has_one" {
-					if ft.Type.Kind() != reflect.Ptr {
-						return "", "", res, errors.New(ft.Name + " should be pointer")
-					}
-					orType = ft.Type.Elem()
-				} else if orTag == "has_many" {
-					if ft.Type.Kind() != reflect.Slice {
-						return "", "", res, errors.New(ft.Name + " should be slice of pointer")
-					}
-					elemType := ft.Type.Elem()
-					if elemType.Kind() != reflect.Ptr {
-						return "", "", res, errors.New(ft.Name + " should be slice of pointer")
-					}
-					orType = elemType.Elem()
-				} else if orTag == "belongs_to" {
-					if ft.Type.Kind() != reflect.Ptr {
-						return "", "", res, errors.New(ft.Name + " should be pointer")
-					}
-					orType = ft.Type.Elem()
-				}
-				orTableName := ft.Tag.Get("table")
-				if orTableName == "" {
-					return "", "", res, errors.New("invalid table name in or tag on field: " + ft.Name)
-				}
-				res = append(res, &orColumn{
-					fieldName: ft.Name,
-					or:        orTag,
-					table:     orTableName,
-					orType:    orType,
-				})
-			} else {
-				return "", "", res, errors.New("unsupported or tag: " + orTag + ", only support has_one, has_many and belongs_to for now")
-			}
-		}
-		dbTag := ft.Tag.Get("db")
-		dbCol := getDbTagCol(dbTag)
-		if dbCol == "" { //兼容json标签
-			jsonTag := ft.Tag.Get("json")
-			if jsonTag != "" {
-				dbCol = strings.Split(jsonTag, ",")[0]
-			}
-		}
-		if ft.Tag.Get("pk") == "true" || isPkOrAi(dbTag, "pk") {
-			pkCol = dbCol
-			if pkCol == "" {
-				pkCol = fieldName2ColName(ft.Name)
-			}
-			pkField = ft.Name
-		}
+func getOrColumnsByType(t reflect.Type) ([]string, []string, []*orColumn, error) {
+	m := getModelMeta(t)
+	if m.relErr != nil {
+		return nil, nil, m.relations, m.relErr
 	}
-	return pkField, pkCol, res, nil
+	return m.pkFields, m.pkCols, m.relations, nil
 }
 
 /**
@@ -447,62 +487,41 @@ func getTableName(s interface{}) string {
 	return fieldName2ColName(ts.Name())
 }
 
-func selectByPK(c context.Context, tdx Tdx, s interface{}, pk interface{}) error {
-	pkName := getPKColumn(s)
+func selectByPK(c context.Context, tdx Tdx, s interface{}, pks ...interface{}) error {
+	t := reflect.TypeOf(s).Elem()
+	_, pkCols := getPkColumnsByType(t)
 	tabName := getTableName(s)
-	if pkName == "" {
-		return errors.New(tabName + " does not have primary key")
+	if len(pkCols) == 0 {
+		return fmt.Errorf("%s %w", tabName, ErrNoPrimaryKey)
+	}
+	if len(pks) != len(pkCols) {
+		return fmt.Errorf("%s has %d primary keys, but got %d values", tabName, len(pkCols), len(pks))
 	}
-	return selectOne(c, tdx, s, fmt.Sprintf("select * from %s where %s = ?", tabName, pkName), pk)
+	where := pkWhereSQL(pkCols)
+	if f := softDeleteField(c, t); f != nil {
+		where += " and " + f.column + " IS NULL"
+	}
+	return selectOne(c, tdx, s, fmt.Sprintf("select * from %s where %s", tabName, where), pks...)
 }
 
 func selectOne(c context.Context, tdx Tdx, s interface{}, query string, args ...interface{}) error {
-	query = addLimit(query, 1)
-	// One time there only can be one active sql Rows query
-	err := selectOneInternal(c, tdx, s, query, args...)
+	query = lockSQL(c, addLimit(query, 1), false)
+	//Preload只用于这次查询的类型，在查询之前检查关联是否存在
+	t := reflect.TypeOf(s).Elem()
+	tree, err := relationTree(c, t)
 	if err != nil {
 		return err
 	}
-	pkField, pkCol, orColumns, err := getOrColumns(s)
-	if err != nil {
+	c = withoutPreload(c)
+	// One time there only can be one active sql Rows query
+	if err := selectOneInternal(c, tdx, s, query, args...); err != nil {
 		return err
 	}
-	if orColumns != nil && len(orColumns) > 0 {
-		v := reflect.ValueOf(s).Elem()
-		pkValue, err := getFieldValue(s, pkField)
-		if err != nil {
-			return err
-		}
-		for _, orCol := range orColumns {
-			if orCol.or == "has_one" {
-				err = processOrHasOneRelation(c, tdx, orCol, v, pkCol, pkValue)
-				if err != nil {
-					return err
-				}
-			} else if orCol.or == "has_many" {
-				orField := v.FieldByName(orCol.fieldName)
-				err = selectManyInternal(c, tdx, orField.Addr().Interface(), false,
-					"SELECT * FROM "+orCol.table+" WHERE "+pkCol+" = ?", pkValue)
-				if err != nil {
-					return err
-				}
-			} else if orCol.or == "belongs_to" {
-				fk := getPkColumnByType(orCol.orType)
-				if fk == "" {
-					return errors.New("error while getting primary key of " + orCol.table + " for belongs_to")
-				}
-				fkValue, err := getFieldValue(s, colName2FieldName(fk))
-				if err != nil {
-					return err
-				}
-				err = processOrBelongsToRelation(c, tdx, orCol, v, fk, fkValue)
-				if err != nil {
-					return err
-				}
-			}
-		}
+	values := []reflect.Value{reflect.ValueOf(s)}
+	if err := loadRelations(c, tdx, t, values, tree); err != nil {
+		return err
 	}
-	return nil
+	return afterLoad(c, tdx, t, values)
 }
 
 func selectOneInternal(c context.Context, tdx Tdx, s interface{}, queryStr string, args ...interface{}) error {
@@ -513,7 +532,10 @@ func selectOneInternal(c context.Context, tdx Tdx, s interface{}, queryStr strin
 	defer rows.Close()
 
 	if !rows.Next() {
-		return sql.ErrNoRows
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return ErrRecordNotFound
 	}
 	cols, err := rows.Columns()
 	if err != nil {
@@ -527,57 +549,6 @@ func selectOneInternal(c context.Context, tdx Tdx, s interface{}, queryStr strin
 	return nil
 }
 
-func processOrHasOneRelation(c context.Context, tdx Tdx, orCol *orColumn, v reflect.Value, pkCol string, pkValue interface{}) error {
-	queryStr := fmt.Sprintf("SELECT * FROM `%s` WHERE `%s` = ? LIMIT 1", orCol.table, pkCol)
-	rows, err := query(c, tdx, queryStr, pkValue)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	if !rows.Next() {
-		return nil
-	}
-	cols, err := rows.Columns()
-	if err != nil {
-		return err
-	}
-	orField := v.FieldByName(orCol.fieldName)
-	orValue := reflect.New(orField.Type().Elem())
-	err = reflectStructValue(orValue, orField.Type().Elem(), cols, rows)
-	if err != nil {
-		return err
-	}
-	orField.Set(orValue)
-	return nil
-}
-
-func processOrBelongsToRelation(c context.Context, tdx Tdx, orCol *orColumn, v reflect.Value, fk string, fkValue interface{}) error {
-	queryStr := fmt.Sprintf("SELECT * FROM %s WHERE %s = ? LIMIT 1", orCol.table, fk)
-	orRows, err := query(c, tdx, queryStr, fkValue)
-	if err != nil {
-		return err
-	}
-	defer orRows.Close()
-
-	if !orRows.Next() {
-		return nil
-	}
-	orCols, err := orRows.Columns()
-	if err != nil {
-		return err
-	}
-	orField := v.FieldByName(orCol.fieldName)
-	orValue := reflect.New(orField.Type().Elem())
-	err = reflectStructValue(orValue, orField.Type().Elem(), orCols, orRows)
-
-	if err != nil {
-		return err
-	}
-	orField.Set(orValue)
-	return nil
-}
-
 func selectStr(c context.Context, tdx Tdx, queryStr string, args ...interface{}) (string, error) {
 	queryStr = addLimit(queryStr, 1)
 	rows, err := query(c, tdx, queryStr, args...)
@@ -587,7 +558,10 @@ func selectStr(c context.Context, tdx Tdx, queryStr string, args ...interface{})
 	defer rows.Close()
 
 	if !rows.Next() {
-		return "", sql.ErrNoRows
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		return "", ErrRecordNotFound
 	}
 	ret := ""
 	err = rows.Scan(&ret)
@@ -604,7 +578,10 @@ func selectInt(c context.Context, tdx Tdx, queryStr string, args ...interface{})
 	defer rows.Close()
 
 	if !rows.Next() {
-		return ret, sql.ErrNoRows
+		if err := rows.Err(); err != nil {
+			return ret, err
+		}
+		return ret, ErrRecordNotFound
 	}
 
 	err = rows.Scan(&ret)
@@ -693,7 +670,7 @@ func selectRawSet(c context.Context, tdx Tdx, queryStr string, columnMaps map[st
 		}
 		dataSet = append(dataSet, itemMap)
 	}
-	return dataSet, nil
+	return dataSet, rows.Err()
 }
 
 func selectRaw(c context.Context, tdx Tdx, queryStr string, args ...interface{}) ([]string, [][]interface{}, error) {
@@ -748,7 +725,7 @@ func selectRaw(c context.Context, tdx Tdx, queryStr string, args ...interface{})
 		}
 		data = append(data, itemMap)
 	}
-	return colNames, data, nil
+	return colNames, data, rows.Err()
 }
 
 func selectRawWithParam(c context.Context, tdx Tdx, paramQuery string, paramMap interface{}) ([]string, [][]interface{}, error) {
@@ -786,12 +763,12 @@ func selectRawSetWithParam(c context.Context, tdx Tdx, paramQuery string, paramM
 }
 
 func selectMany(c context.Context, tdx Tdx, s interface{}, query string, args ...interface{}) error {
-	query = addLimit(query, 0)
-	return selectManyInternal(c, tdx, s, true, query, args...)
+	query = lockSQL(c, addLimit(query, 0), false)
+	return selectManyInternal(c, tdx, s, query, args...)
 }
 
 //搜索一个数组，并支持关联，当搜索单数组
-func selectManyInternal(c context.Context, tdx Tdx, s interface{}, processOr bool, queryStr string, args ...interface{}) error {
+func selectManyInternal(c context.Context, tdx Tdx, s interface{}, queryStr string, args ...interface{}) error {
 	t, err := toSliceType(s)
 	if err != nil {
 		return err
@@ -805,22 +782,17 @@ func selectManyInternal(c context.Context, tdx Tdx, s interface{}, processOr boo
 
 	var isPtr = t.Kind() == reflect.Ptr
 
-	hasOrCols := false
-	pkCol := ""
-	pkField := ""
-	var orCols []*orColumn = nil
+	var tree preloadTree
+	var findHook bool
 	if isPtr {
 		t = t.Elem()
-		if processOr {
-			pkField, pkCol, orCols, err = getOrColumnsByType(t)
-			if err != nil {
-				return err
-			}
-			if orCols != nil && len(orCols) > 0 {
-				hasOrCols = true
-			}
+		tree, err = relationTree(c, t)
+		if err != nil {
+			return err
 		}
+		findHook = needAfterLoad(t)
 	}
+	c = withoutPreload(c)
 	//进行查询
 	sliceValue := reflect.Indirect(reflect.ValueOf(s))
 	rows, err := query(c, tdx, queryStr, args...)
@@ -829,46 +801,26 @@ func selectManyInternal(c context.Context, tdx Tdx, s interface{}, processOr boo
 	}
 	defer rows.Close()
 
-	keys := make([]interface{}, 0)
-	resMap := map[interface{}]reflect.Value{}
-	for rows.Next() {
+	//字段的映射关系对于所有行都是一样的，只需要计算一次
+	var idxes [][]int
+	if isPtr {
 		cols, err := rows.Columns()
 		if err != nil {
 			return err
 		}
+		idxes = getModelMeta(t).scanIndexes(cols)
+	}
+	values := make([]reflect.Value, 0)
+	for rows.Next() {
 		v := reflect.New(t)
 		if isPtr {
-			targets := make([]interface{}, len(cols))
-			//修改映射关系
-			dbTags := getDbTagMap(t, len(cols))
-			for k, c := range cols {
-				fName := ""
-				if temp, ok := dbTags[c]; ok {
-					fName = temp
-				} else {
-					fName = colName2FieldName(c)
-				}
-				fv := v.Elem().FieldByName(fName)
-				if !fv.CanAddr() {
-					logrus.WithField("sql", queryStr).Warnf("missing field: %s", fName)
-					var b interface{}
-					targets[k] = &b
-				} else {
-					targets[k] = fv.Addr().Interface()
-				}
-			}
-			err = rows.Scan(targets...)
+			err = rows.Scan(getModelMeta(t).scanTargets(v.Elem(), idxes)...)
 			if err != nil {
 				return err
 			}
 			sliceValue.Set(reflect.Append(sliceValue, v))
-			if hasOrCols {
-				pkFv := v.Elem().FieldByName(pkField)
-				if pkFv.IsValid() {
-					key := pkFv.Interface()
-					keys = append(keys, key)
-					resMap[key] = v
-				}
+			if len(tree) > 0 || findHook {
+				values = append(values, v)
 			}
 		} else {
 			err = rows.Scan(v.Interface())
@@ -878,142 +830,102 @@ func selectManyInternal(c context.Context, tdx Tdx, s interface{}, processOr boo
 			sliceValue.Set(reflect.Append(sliceValue, v.Elem()))
 		}
 	}
-	if len(keys) > 0 {
-		for _, orCol := range orCols {
-			var sqlQuery string
-			// 如果是belongs_to，需要先把fk -> array(elem)存下来，然后根据数据库请求结果将对应fk的指针指向相应的关联对象
-			if orCol.or == "belongs_to" {
-				fk := getPkColumnByType(orCol.orType)
-				if fk == "" {
-					return errors.New("error while getting primary key of " + orCol.table + " for belongs_to")
-				}
-				fkCol := colName2FieldName(fk)
-				fkValues := make([]interface{}, 0)
-				fkMaps := map[interface{}][]reflect.Value{}
-				i := 0
-				for _, value := range resMap {
-					fkValue, err := getFieldValue(value.Interface(), fkCol)
-					if err != nil {
-						return err
-					}
-					fkValues = append(fkValues, fkValue)
-					if v, ok := fkMaps[fkValue]; ok {
-						fkMaps[fkValue] = append(v, value)
-					} else {
-						fkMaps[fkValue] = make([]reflect.Value, 0)
-						fkMaps[fkValue] = append(fkMaps[fkValue], value)
-					}
-					i = i + 1
-				}
-				sqlQuery = makeString("SELECT * FROM "+orCol.table+" WHERE "+fk+" in (", ",", ")", fkValues)
-				orRows, err := query(c, tdx, sqlQuery)
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := loadRelations(c, tdx, t, values, tree); err != nil {
+		return err
+	}
+	return afterLoad(c, tdx, t, values)
+}
 
-				if err != nil {
-					return err
-				}
-				defer orRows.Close()
-				for orRows.Next() {
-					orCols, err := orRows.Columns()
-					if err != nil {
-						return err
-					}
-					orValue := reflect.New(orCol.orType)
-					err = reflectStructValue(orValue, orCol.orType, orCols, orRows)
-					if err != nil {
-						return err
-					}
-					keyValue := orValue.Elem().FieldByName(fkCol)
-					if keyValue.IsValid() {
-						if arr, ok := fkMaps[keyValue.Interface()]; ok {
-							for _, v := range arr {
-								v.Elem().FieldByName(orCol.fieldName).Set(orValue)
-							}
-						}
-
-					}
-				}
-			} else {
-				sqlQuery = makeString("SELECT * FROM "+orCol.table+" WHERE "+pkCol+" in (",
-					",", ")", keys)
-				orRows, err := query(c, tdx, sqlQuery)
+var relationChunkSize = 1000
 
-				if err != nil {
-					return err
-				}
-				defer orRows.Close()
-				for orRows.Next() {
-					orCols, err := orRows.Columns()
-					if err != nil {
-						return err
-					}
-					orValue := reflect.New(orCol.orType)
-					err = reflectStructValue(orValue, orCol.orType, orCols, orRows)
-					if err != nil {
-						return err
-					}
-					keyValue := orValue.Elem().FieldByName(pkField)
-					if keyValue.IsValid() {
-						if v, ok := resMap[keyValue.Interface()]; ok {
-							if orCol.or == "has_one" {
-								v.Elem().FieldByName(orCol.fieldName).Set(orValue)
-							} else if orCol.or == "has_many" {
-								orSliceValue := v.Elem().FieldByName(orCol.fieldName)
-								orSliceValue.Set(reflect.Append(orSliceValue, orValue))
-							}
-						}
-					}
-				}
-			}
+// SetRelationChunkSize 设置批量加载关联时每条sql中IN列表的最大长度，超过时拆分为多次查询，默认为1000
+func SetRelationChunkSize(n int) {
+	if n > 0 {
+		relationChunkSize = n
+	}
+}
+
+// 通过cols in (keys)批量查询关联表，keys按照relationChunkSize拆分为多次查询，每一行结果都会调用fn
+func selectRelation(c context.Context, tdx Tdx, orCol *orColumn, cols []string, keys [][]interface{}, fn func(orValue reflect.Value)) error {
+	for start := 0; start < len(keys); start += relationChunkSize {
+		end := start + relationChunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		where, args := inSQL(cols, keys[start:end])
+		if f := softDeleteField(c, orCol.orType); f != nil {
+			where += " AND " + f.column + " IS NULL"
+		}
+		queryStr := lockSQL(c, "SELECT * FROM "+orCol.table+" WHERE "+where, true)
+		if err := selectRelationChunk(c, tdx, orCol, queryStr, args, fn); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func makeString(start, split, end string, ids []interface{}) string {
-	buff := bytes.Buffer{}
-	buff.WriteString(start)
-	len := len(ids)
-	for i, v := range ids {
-		buff.WriteString(fmt.Sprintf("%v", v))
-		if i < len-1 {
-			buff.WriteString(split)
+func selectRelationChunk(c context.Context, tdx Tdx, orCol *orColumn, queryStr string, args []interface{}, fn func(orValue reflect.Value)) error {
+	orRows, err := queryWithoutLimit(c, tdx, queryStr, args...)
+	if err != nil {
+		return err
+	}
+	defer orRows.Close()
+	orCols, err := orRows.Columns()
+	if err != nil {
+		return err
+	}
+	orMeta := getModelMeta(orCol.orType)
+	orIdxes := orMeta.scanIndexes(orCols)
+	for orRows.Next() {
+		orValue := reflect.New(orCol.orType)
+		if err := orRows.Scan(orMeta.scanTargets(orValue.Elem(), orIdxes)...); err != nil {
+			return err
 		}
+		fn(orValue)
 	}
-	buff.WriteString(end)
-	return buff.String()
+	return orRows.Err()
 }
 
 var zeroTime = time.Unix(1, 0)
 
+// 主键信息，联合主键时names和values有多个
+type pkInfo struct {
+	names  []string
+	values []reflect.Value
+	ai     int //自增主键在names中的下标，没有自增主键时为-1
+}
+
+func newPkInfo() *pkInfo {
+	return &pkInfo{ai: -1}
+}
+
+func (p *pkInfo) add(name string, value reflect.Value, isAi bool) {
+	if isAi {
+		p.ai = len(p.names)
+	}
+	p.names = append(p.names, name)
+	p.values = append(p.values, value)
+}
+
+func (p *pkInfo) args() []interface{} {
+	ret := make([]interface{}, len(p.values))
+	for i, v := range p.values {
+		ret[i] = v.Interface()
+	}
+	return ret
+}
+
 //通过fields中的字段获取部分数据以及主建和主键的值
-func columnsByStructFields(s interface{}, cols []string) ([]interface{}, reflect.Value, bool, string) {
-	t := reflect.TypeOf(s).Elem()
+func columnsByStructFields(s interface{}, cols []string) ([]interface{}, *pkInfo) {
 	v := reflect.ValueOf(s).Elem()
 	ret := make([]interface{}, 0, len(cols))
-	var pk reflect.Value
-	var pkName string
-	isAi := false
-	//反射遍历整个struct找到主键和主键的值，一般都是第一个
-	for k := 0; k < t.NumField(); k++ {
-		ft := t.Field(k)
-		//先匹配db中的pk
-		dbTag := ft.Tag.Get("db")
-		dbCol := getDbTagCol(dbTag)
-		jsonTag := strings.Split(ft.Tag.Get("json"), ",")[0]
-		if ft.Tag.Get("pk") == "true" || isPkOrAi(dbTag, "pk") {
-			pk = v.Field(k)
-			pkName = dbCol
-			if jsonTag != "" && pkName == "" {
-				pkName = jsonTag
-			}
-			if pkName == "" {
-				pkName = fieldName2ColName(ft.Name)
-			}
-			if ft.Tag.Get("ai") == "true" || isPkOrAi(dbTag, "ai") {
-				isAi = true
-			}
-			break
-		}
+	pk := newPkInfo()
+	//找到主键和主键的值，联合主键时有多个
+	for _, f := range getModelMeta(v.Type()).pks {
+		pk.add(f.column, v.Field(f.index), f.ai)
 	}
 	//通过cols获取struct中的值
 	for _, value := range cols {
@@ -1026,98 +938,33 @@ func columnsByStructFields(s interface{}, cols []string) ([]interface{}, reflect
 		}
 		ret = append(ret, r)
 	}
-	return ret, pk, isAi, pkName
+	return ret, pk
 }
 
 /**
 解析一个struct，解析适合数据库操作的cols，vals,args，还有主键和主键值
 */
-func columnsByStruct(s interface{}) (string, string, []interface{}, reflect.Value, bool, string) {
-	t := reflect.TypeOf(s).Elem()
+func columnsByStruct(s interface{}) (string, string, []interface{}, *pkInfo) {
 	v := reflect.ValueOf(s).Elem()
-	cols := ""
-	vals := ""
-	ret := make([]interface{}, 0, t.NumField())
-	n := 0
-	var pk reflect.Value
-	var pkName string
-	isAi := false
-	for k := 0; k < t.NumField(); k++ {
-		ft := t.Field(k)
-		//优先对标签进行处理，当没有找到标签时，就直接对struct的字段进行转化
-
-		dbTag := ft.Tag.Get("db")
-		str := getDbTagCol(dbTag)
-		if str == "" {
-			str = strings.Split(ft.Tag.Get("json"), ",")[0]
-			if str == "" {
-				str = fieldName2ColName(ft.Name)
-			}
-		}
-		//auto increment field
-		if ft.Tag.Get("pk") == "true" || isPkOrAi(dbTag, "pk") {
-			pk = v.Field(k)
-			pkName = str
-			if pkName == "" {
-				pkName = fieldName2ColName(ft.Name)
-			}
-			if ft.Tag.Get("ai") == "true" || isPkOrAi(dbTag, "ai") {
-				isAi = true
-				continue
-			}
-		}
-
-		//auto update filed, created_at, updated_at, etc.
-		if ft.Tag.Get("ignore") == "true" || ft.Tag.Get("or") != "" {
-			continue
-		}
-
-		if n > 0 {
-			cols += ","
-			vals += ","
-		}
-		cols += str
-		vals += "?"
-		r := v.Field(k).Addr().Interface()
-		if v.Field(k).Type().String() == "time.Time" {
-			if r.(*time.Time).IsZero() {
-				r = &zeroTime
-			}
-		}
-
-		ret = append(ret, r)
-		n += 1
+	m := getModelMeta(v.Type())
+	ret := make([]interface{}, len(m.inserts))
+	for i, f := range m.inserts {
+		ret[i] = fieldArg(v, f)
+	}
+	pk := newPkInfo()
+	for _, f := range m.pks {
+		pk.add(f.column, v.Field(f.index), f.ai)
 	}
-	return cols, vals, ret, pk, isAi, pkName
+	return m.insertSQL, placeholders(len(m.inserts)), ret, pk
 }
 
-func columnsBySlice(s []interface{}) (string, string, []interface{}, []reflect.Value, []bool) {
+// times为每条记录自动设置的时间字段，和s一一对应
+func columnsBySlice(s []interface{}, times []*autoTimes) (string, string, []interface{}, []reflect.Value, []bool) {
 	t := reflect.TypeOf(s[0]).Elem()
-	ret := make([]interface{}, 0, t.NumField()*len(s))
-	cols := "("
-	isFirst := true
-	for k := 0; k < t.NumField(); k++ {
-		ft := t.Field(k)
-		dbTag := ft.Tag.Get("db")
-		str := getDbTagCol(dbTag)
-		if str == "" {
-			str = fieldName2ColName(ft.Name)
-		}
-		if ft.Tag.Get("pk") == "true" || isPkOrAi(dbTag, "pk") {
-			if ft.Tag.Get("ai") == "true" || isPkOrAi(dbTag, "ai") {
-				continue
-			}
-		}
-		if ft.Tag.Get("ignore") == "true" || ft.Tag.Get("or") != "" {
-			continue
-		}
-		if !isFirst {
-			cols += ","
-		}
-		cols += str
-		isFirst = false
-	}
-	cols += ")"
+	m := getModelMeta(t)
+	ret := make([]interface{}, 0, len(m.inserts)*len(s))
+	cols := "(" + m.insertSQL + ")"
+	holder := "(" + placeholders(len(m.inserts)) + ")"
 
 	vals := bytes.Buffer{}
 	pks := make([]reflect.Value, len(s))
@@ -1131,132 +978,360 @@ func columnsBySlice(s []interface{}) (string, string, []interface{}, []reflect.V
 		if n > 0 {
 			vals.WriteString(",")
 		}
-		vals.WriteString("(")
-		isFirst := true
-		for k := 0; k < t.NumField(); k++ {
-			ft := t.Field(k)
-			dbTag := ft.Tag.Get("db")
-			//auto increment field
-			if ft.Tag.Get("pk") == "true" || isPkOrAi(dbTag, "pk") {
-				if ft.Tag.Get("ai") == "true" || isPkOrAi(dbTag, "ai") {
-					pks[n] = v.Field(k)
-					ais[n] = true
-					continue
-				}
-			}
-
-			//auto update filed, created_at, updated_at, etc.
-			if ft.Tag.Get("ignore") == "true" || ft.Tag.Get("or") != "" {
-				continue
-			}
-
-			if !isFirst {
-				vals.WriteString(",")
-			}
-			vals.WriteString("?")
-			isFirst = false
-			r := v.Field(k).Addr().Interface()
-			if v.Field(k).Type().String() == "time.Time" {
-				if r.(*time.Time).IsZero() {
-					r = &zeroTime
-				}
-			}
-			ret = append(ret, r)
+		vals.WriteString(holder)
+		//auto increment field
+		if m.ai != nil {
+			pks[n] = v.Field(m.ai.index)
+			ais[n] = true
+		}
+		for _, f := range m.inserts {
+			ret = append(ret, times[n].arg(v, f))
 		}
-		vals.WriteString(")")
 	}
 
 	return cols, vals.String(), ret, pks, ais
 }
 
+// n个以逗号分隔的?
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
 func insert(c context.Context, tdx Tdx, s interface{}) error {
 	return insertByTable(c, tdx, getTableName(s), s)
 }
 
 func insertByTable(c context.Context, tdx Tdx, tableName string, s interface{}) error {
-	cols, vals, ifs, pk, isAi, _ := columnsByStruct(s)
+	if err := beforeInsert(c, tdx, s); err != nil {
+		return err
+	}
+	v := reflect.ValueOf(s).Elem()
+	times := insertTimes(v, currentTime())
+	cols, vals, ifs, pk := columnsByStruct(s)
+	times.replaceArgs(v, ifs)
 	ret, err := exec(c, tdx, fmt.Sprintf("insert into %s (%s) values(%s)", tableName, cols, vals), ifs...)
 	if err != nil {
 		return err
 	}
-	if isAi {
+	if pk.ai >= 0 {
 		lid, err := ret.LastInsertId()
 		if err != nil {
 			return err
 		}
-		pk.SetInt(lid)
+		if err := setAutoIncrementValue(pk.values[pk.ai], lid); err != nil {
+			return err
+		}
 	}
-	return nil
+	if err := times.apply(v, true); err != nil {
+		return err
+	}
+	saveSnapshot(v, nil)
+	return afterInsert(c, tdx, s)
 }
 
 //更新或者插入，on duplicate key,	其中keys只支持写入数据库对应的字段
 func insertOrUpdate(c context.Context, tdx Tdx, s interface{}, fields []string) error {
-	cols, vals, ifs, pk, isAi, pkName := columnsByStruct(s)
+	v := reflect.ValueOf(s).Elem()
+	m := getModelMeta(v.Type())
+	//autoUpdateTime字段在insert和update时都设置为当前时间，autoCreateTime字段只在insert时写入
+	times := insertTimes(v, currentTime())
+	times.updates = m.updateTimes
+	cols, vals, ifs, pk := columnsByStruct(s)
+	times.replaceArgs(v, ifs)
+	ver, err := versionField(s)
+	if err != nil {
+		return err
+	}
 	//重复时，需要更新的字段
-	for k, v := range fields {
-		v = fieldName2ColName(v)
-		str := fmt.Sprintf("%s=values(%s)", v, v)
-		fields[k] = str
-	}
-	//检查主键的情况，在insert中加入主键
-	if pk.Addr().Interface() != nil {
-		cols += fmt.Sprintf(",%s", pkName)
+	updates := make([]string, 0, len(fields)+len(m.updateTimes))
+	for _, name := range fields {
+		col := fieldName2ColName(name)
+		if f := m.lookupField(name); f != nil {
+			col = f.column
+		}
+		//创建时间只在insert时写入，重复时不更新
+		if isCreateTimeColumn(m, col) {
+			continue
+		}
+		updates = append(updates, col)
+	}
+	for _, f := range m.updateTimes {
+		if !containString(updates, f.column) {
+			updates = append(updates, f.column)
+		}
+	}
+	fields = make([]string, 0, len(updates)+1)
+	for _, col := range updates {
+		str := fmt.Sprintf("%s=values(%s)", col, col)
+		if ver != nil {
+			//有版本号时只有版本号一致才更新
+			str = fmt.Sprintf("%s=IF(%s = values(%s), values(%s), %s)", col, ver.column, ver.column, col, col)
+		}
+		fields = append(fields, str)
+	}
+	if ver != nil {
+		//版本号需要放在最后更新，否则前面的条件会使用更新后的版本号
+		fields = append(fields, fmt.Sprintf("%s=IF(%s = values(%s), %s + 1, %s)", ver.column, ver.column, ver.column, ver.column, ver.column))
+	}
+	//非自增的主键已经在cols中，这里只需要把自增主键加入insert，值为0时由数据库生成
+	if pk.ai >= 0 {
+		cols += fmt.Sprintf(",%s", pk.names[pk.ai])
 		vals += ",?"
-		ifs = append(ifs, pk.Addr().Interface())
+		ifs = append(ifs, pk.values[pk.ai].Addr().Interface())
 	}
 	q := fmt.Sprintf("insert into %s (%s) values (%s) on duplicate key update %s", getTableName(s), cols, vals, strings.Join(fields, ","))
 	ret, err := exec(c, tdx, q, ifs...)
 	if err != nil {
 		return err
 	}
-	if isAi {
+	//insert时影响1行，update时影响2行，没有更新(包括版本号不一致)时为0行
+	ra, err := ret.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if ver != nil {
+		if ra == 0 {
+			return fmt.Errorf("%s %w", getTableName(s), ErrStaleObject)
+		}
+		if ra == 2 {
+			increaseVersion(v.Field(ver.index))
+		}
+	}
+	if ra > 0 {
+		if err := times.apply(v, ra == 1); err != nil {
+			return err
+		}
+	}
+	if pk.ai >= 0 {
 		lid, err := ret.LastInsertId()
 		if err != nil {
 			return err
 		}
-		pk.SetInt(lid)
+		return setAutoIncrementValue(pk.values[pk.ai], lid)
 	}
 	return nil
 }
 
 //通过传递需要更新的字段,去更新部分字段
+//cols可以是struct中的字段名，也可以是数据库字段名，按照db和json标签匹配
 func updateFieldsByPK(c context.Context, tdx Tdx, s interface{}, cols []string) error {
-	ifs, pk, _, pkName := columnsByStructFields(s, cols)
-	cs := make([]string, 0)
+	if err := beforeUpdate(c, tdx, s); err != nil {
+		return err
+	}
+	m := getModelMeta(reflect.TypeOf(s).Elem())
+	fields := make([]*modelField, 0, len(cols))
 	for _, col := range cols {
-		cs = append(cs, fieldName2ColName(col)+" = ?")
+		//ignore标签的字段可以指定更新，例如没有autoUpdateTime标签的updated_at
+		f := m.lookupField(col)
+		if f == nil || f.virtual {
+			return &MissingFieldError{Table: getTableName(s), Field: col}
+		}
+		fields = append(fields, f)
 	}
-	sv := strings.Join(cs, ",")
-	q := fmt.Sprintf("update %s set %s where %s = %d", getTableName(s), sv, pkName, pk.Int())
-	_, err := exec(c, tdx, q, ifs...)
+	return updateModelFields(c, tdx, s, fields)
+}
+
+// 按照主键更新fields，版本号字段会被跳过，由updateWithPK处理
+func updateModelFields(c context.Context, tdx Tdx, s interface{}, fields []*modelField) error {
+	_, pk := columnsByStructFields(s, nil)
+	if len(pk.names) == 0 {
+		return fmt.Errorf("%s %w", getTableName(s), ErrNoPrimaryKey)
+	}
+	v := reflect.ValueOf(s).Elem()
+	times := updateTimes(v, currentTime())
+	for _, f := range times.updates {
+		if !containField(fields, f) {
+			fields = append(fields, f)
+		}
+	}
+	ver, err := versionField(s)
 	if err != nil {
 		return err
 	}
-	return nil
+	cs := make([]string, 0, len(fields))
+	args := make([]interface{}, 0, len(fields))
+	for _, f := range fields {
+		if f == ver {
+			continue
+		}
+		cs = append(cs, f.column+" = ?")
+		args = append(args, times.arg(v, f))
+	}
+	if err := updateWithPK(c, tdx, s, cs, args, pk, ver); err != nil {
+		return err
+	}
+	if err := times.apply(v, false); err != nil {
+		return err
+	}
+	if ver != nil {
+		fields = append(fields, ver)
+	}
+	saveSnapshot(v, fields)
+	return afterUpdate(c, tdx, s)
+}
+
+// 按照主键执行update，sets为set的各个字段，有版本号时增加版本号的条件并且版本号加1
+func updateWithPK(c context.Context, tdx Tdx, s interface{}, sets []string, args []interface{}, pk *pkInfo, ver *modelField) error {
+	where := pkWhereSQL(pk.names)
+	args = append(args, pk.args()...)
+	if ver != nil {
+		sets = append(sets, ver.column+" = "+ver.column+" + 1")
+		where += " and " + ver.column + " = ?"
+		args = append(args, reflect.ValueOf(s).Elem().Field(ver.index).Interface())
+	}
+	q := fmt.Sprintf("update %s set %s where %s", getTableName(s), strings.Join(sets, ","), where)
+	if ver != nil {
+		return execWithVersion(c, tdx, s, ver, q, args...)
+	}
+	_, err := exec(c, tdx, q, args...)
+	return err
 }
 
 func updateByPK(c context.Context, tdx Tdx, s interface{}) error {
-	colStr, _, ifs, pk, _, pkName := columnsByStruct(s)
+	if err := beforeUpdate(c, tdx, s); err != nil {
+		return err
+	}
+	colStr, _, ifs, pk := columnsByStruct(s)
+	if len(pk.names) == 0 {
+		return fmt.Errorf("%s %w", getTableName(s), ErrNoPrimaryKey)
+	}
+	v := reflect.ValueOf(s).Elem()
+	times := updateTimes(v, currentTime())
+	times.replaceArgs(v, ifs)
 	cols := strings.Split(colStr, ",")
+	ver, err := versionField(s)
+	if err != nil {
+		return err
+	}
+	m := getModelMeta(v.Type())
 	cs := make([]string, 0)
-	for _, col := range cols {
+	args := make([]interface{}, 0, len(ifs))
+	for i, col := range cols {
+		if ver != nil && col == ver.column {
+			continue
+		}
+		//创建时间只在insert时写入
+		if isCreateTimeColumn(m, col) {
+			continue
+		}
 		cs = append(cs, col+" = ?")
+		args = append(args, ifs[i])
 	}
-	sv := strings.Join(cs, ",")
-	q := fmt.Sprintf("update %s set %s where %s = %d", getTableName(s), sv, pkName, pk.Int())
-	_, err := exec(c, tdx, q, ifs...)
-	if err != nil {
+	if err := updateWithPK(c, tdx, s, cs, args, pk, ver); err != nil {
 		return err
 	}
-	return nil
+	if err := times.apply(v, false); err != nil {
+		return err
+	}
+	saveSnapshot(v, nil)
+	return afterUpdate(c, tdx, s)
+}
+
+// 通过主键删除一条记录，checkRowAffect为true时要求正好删除一行
+func deleteByPK(c context.Context, tdx Tdx, s interface{}, checkRowAffect bool) error {
+	_, pk := columnsByStructFields(s, nil)
+	tabName := getTableName(s)
+	if len(pk.names) == 0 {
+		return fmt.Errorf("%s %w", tabName, ErrNoPrimaryKey)
+	}
+	if err := beforeDelete(c, tdx, s); err != nil {
+		return err
+	}
+	v := reflect.Indirect(reflect.ValueOf(s))
+	if f := softDeleteField(c, v.Type()); f != nil {
+		//软删除只更新删除时间，已经删除的记录不会被再次更新
+		now := currentTime()
+		q := fmt.Sprintf("update %s set %s = ? where %s and %s IS NULL", tabName, f.column, pkWhereSQL(pk.names), f.column)
+		args := append([]interface{}{now}, pk.args()...)
+		var err error
+		if checkRowAffect {
+			err = execWithRowAffectCheck(c, tdx, 1, q, args...)
+		} else {
+			_, err = exec(c, tdx, q, args...)
+		}
+		if err != nil {
+			return err
+		}
+		return setTimeValue(v.Field(f.index), &now)
+	}
+	q := fmt.Sprintf("delete from %s where %s", tabName, pkWhereSQL(pk.names))
+	if checkRowAffect {
+		return execWithRowAffectCheck(c, tdx, 1, q, pk.args()...)
+	}
+	_, err := exec(c, tdx, q, pk.args()...)
+	return err
+}
+
+// 批量通过主键删除，sample只用于获取表名和主键，pks为主键的slice，返回删除的行数。
+// 联合主键时pks的每个元素也是slice，按照struct中主键定义的顺序给出各个主键的值
+func deleteByPKs(c context.Context, tdx Tdx, sample interface{}, pks interface{}) (int64, error) {
+	t := reflect.TypeOf(sample)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	_, pkCols := getPkColumnsByType(t)
+	tabName := getTableName(sample)
+	if len(pkCols) == 0 {
+		return 0, fmt.Errorf("%s %w", tabName, ErrNoPrimaryKey)
+	}
+	pv := reflect.ValueOf(pks)
+	if pv.Kind() != reflect.Slice && pv.Kind() != reflect.Array {
+		return 0, errors.New("pks should be slice or array")
+	}
+	if pv.Len() == 0 {
+		return 0, nil
+	}
+	keys := make([][]interface{}, pv.Len())
+	for i := 0; i < pv.Len(); i++ {
+		if len(pkCols) == 1 {
+			keys[i] = []interface{}{pv.Index(i).Interface()}
+			continue
+		}
+		kv := reflect.Indirect(reflect.ValueOf(pv.Index(i).Interface()))
+		if (kv.Kind() != reflect.Slice && kv.Kind() != reflect.Array) || kv.Len() != len(pkCols) {
+			return 0, fmt.Errorf("%s has %d primary keys, each element of pks should be a slice of %d values", tabName, len(pkCols), len(pkCols))
+		}
+		keys[i] = make([]interface{}, kv.Len())
+		for j := 0; j < kv.Len(); j++ {
+			keys[i][j] = kv.Index(j).Interface()
+		}
+	}
+	where, args := inSQL(pkCols, keys)
+	return deleteWhere(c, tdx, sample, where, args...)
+}
+
+// 按照条件删除，where不能为空，返回删除的行数
+func deleteWhere(c context.Context, tdx Tdx, sample interface{}, where string, args ...interface{}) (int64, error) {
+	tabName := getTableName(sample)
+	if strings.TrimSpace(where) == "" {
+		return 0, errors.New("delete from " + tabName + " without where condition is not allowed")
+	}
+	q := fmt.Sprintf("delete from %s where %s", tabName, where)
+	if f := softDeleteField(c, reflect.Indirect(reflect.ValueOf(sample)).Type()); f != nil {
+		q = fmt.Sprintf("update %s set %s = ? where (%s) and %s IS NULL", tabName, f.column, where, f.column)
+		args = append([]interface{}{currentTime()}, args...)
+	}
+	ret, err := exec(c, tdx, q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return ret.RowsAffected()
 }
 
 func insertBatch(c context.Context, tdx Tdx, s []interface{}) error {
 	if s == nil || len(s) == 0 {
 		return nil
 	}
+	now := currentTime()
+	times := make([]*autoTimes, len(s))
+	for i, v := range s {
+		if err := beforeInsert(c, tdx, v); err != nil {
+			return err
+		}
+		times[i] = insertTimes(reflect.ValueOf(v).Elem(), now)
+	}
 	//todo 需要check s中的数据都是同一种类型
-	cols, vals, ifs, pks, ais := columnsBySlice(s)
+	cols, vals, ifs, pks, ais := columnsBySlice(s, times)
 
 	q := fmt.Sprintf("insert into %s %s values %s", getTableName(s[0]), cols, vals)
 	ret, err := exec(c, tdx, q, ifs...)
@@ -1270,45 +1345,123 @@ func insertBatch(c context.Context, tdx Tdx, s []interface{}) error {
 	}
 	for i, _ := range s {
 		if ais[i] {
-			pks[i].SetInt(lastInsertId + int64(i))
+			if err := setAutoIncrementValue(pks[i], lastInsertId+int64(i)); err != nil {
+				return err
+			}
+		}
+	}
+	for i, v := range s {
+		if err := times[i].apply(reflect.ValueOf(v).Elem(), true); err != nil {
+			return err
+		}
+		saveSnapshot(reflect.ValueOf(v).Elem(), nil)
+		if err := afterInsert(c, tdx, v); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// ORMer ORM和ORMTran共同实现的接口，使用ORMer的代码在事务内外都可以执行，
+// 在ORMTran上调用DoTransaction时会使用savepoint执行嵌套事务
 type ORMer interface {
 	WithContext(c context.Context) ORMer
+	From(interface{}) *QueryBuilder
+	DoTransaction(func(*ORMTran) error) error
+	DoTransactionWithPropagation(Propagation, func(context.Context) error) error
 	SelectOne(interface{}, string, ...interface{}) error
-	SelectByPK(interface{}, interface{}) error
+	SelectByPK(interface{}, ...interface{}) error
 	Select(interface{}, string, ...interface{}) error
 	SelectStr(string, ...interface{}) (string, error)
 	SelectInt(string, ...interface{}) (int64, error)
+	SelectRaw(string, ...interface{}) ([]string, [][]interface{}, error)
+	SelectRawSet(string, map[string]string, ...interface{}) ([]map[string]interface{}, error)
+	SelectRawWithParam(string, interface{}) ([]string, [][]interface{}, error)
+	SelectRawSetWithParam(string, interface{}) ([]map[string]interface{}, error)
 	UpdateByPK(interface{}) error
 	UpdateFieldsByPK(interface{}, []string) error
 	Insert(interface{}) error
+	InsertWithTable(interface{}, string) error
 	InsertOrUpdate(interface{}, []string) error
 	InsertBatch([]interface{}) error
+	AddAssociation(interface{}, string, ...interface{}) error
+	RemoveAssociation(interface{}, string, ...interface{}) (int64, error)
 	Exec(string, ...interface{}) (sql.Result, error)
 	Query(string, ...interface{}) (*sql.Rows, error)
 	ExecWithParam(string, interface{}) (sql.Result, error)
 	ExecWithRowAffectCheck(int64, string, ...interface{}) error
+	DeleteByPK(interface{}) error
+	DeleteByPKWithRowAffectCheck(interface{}) error
+	DeleteByPKs(interface{}, interface{}) (int64, error)
+	DeleteWhere(interface{}, string, ...interface{}) (int64, error)
+	Restore(interface{}) error
+	UpdateChanged(interface{}) error
 }
 
+var (
+	_ ORMer = (*ORM)(nil)
+	_ ORMer = (*ORMTran)(nil)
+)
+
 type ORM struct {
 	ctx context.Context
 
 	db *sql.DB
 
+	//从库，读操作会按照policy分配到从库上
+	replicas []*sql.DB
+	policy   ReplicaPolicy
+	master   bool
+
+	//为true时忽略软删除
+	unscoped bool
+
+	//为空时使用全局的sqlLogger
+	logger SqlLogger
+
+	//不为nil时只加载指定的关联
+	preloads []string
+
 	tables map[string]interface{}
 }
 
-func (o *ORM) WithContext(c context.Context) *ORM {
+// WithContext 返回一个使用c执行sql的ORM，需要调用ORM特有的方法时可以转换为*ORM
+func (o *ORM) WithContext(c context.Context) ORMer {
+	return o.withContext(c)
+}
+
+func (o *ORM) withContext(c context.Context) *ORM {
 	no := new(ORM)
 	*no = *o
 	no.ctx = c
 	return no
 }
 
+// 执行sql时使用的context，ORM单独设置的logger和Preload的关联放入context中
+func (o *ORM) context() context.Context {
+	c := o.ctx
+	if o.logger != nil {
+		c = context.WithValue(ensureContext(c), loggerKey{}, o.logger)
+	}
+	if o.preloads != nil {
+		c = withPreload(c, newPreloadTree(o.preloads))
+	}
+	if o.unscoped {
+		c = withUnscoped(c)
+	}
+	return c
+}
+
+// Preload 指定查询时需要加载的关联，多级关联用.分隔，例如 Preload("OrmCs", "OrmCs.Author")。
+// 调用Preload后只会加载指定的关联，Preload()不带参数时不加载任何关联。
+// 指定的关联只用于查询的struct类型，关联和hook中的查询不受影响
+func (o *ORM) Preload(paths ...string) *ORM {
+	no := new(ORM)
+	*no = *o
+	no.preloads = append(append(make([]string, 0, len(o.preloads)+len(paths)), o.preloads...), paths...)
+	return no
+}
+
 func NewORM(ds string) *ORM {
 	return newORMWithDriver(ds, "mysql")
 }
@@ -1318,26 +1471,21 @@ func NewPrestoORM(ds string) *ORM {
 }
 
 func newORMWithDriver(ds string, driverName string) *ORM {
-	initOnce.Do(func() {
-		sqlParamReg, _ = regexp.Compile("(#{[a-zA-Z0-9-_]*})")
-	})
-	ret := &ORM{
-		db:     nil,
-		tables: make(map[string]interface{}),
-	}
-	var err error
-	ret.db, err = sql.Open(driverName, ds)
+	ret, err := NewORMWithConfig(Config{DriverName: driverName, DSN: ds})
 	if err != nil {
 		logrus.WithError(err).Fatal("Can not connect to db")
 	}
-	ret.db.SetMaxOpenConns(100)
-	ret.db.SetMaxIdleConns(5)
-	ret.db.SetConnMaxLifetime(time.Minute * 10)
 	return ret
 }
 
 func (o *ORM) Close() error {
-	return o.db.Close()
+	err := o.db.Close()
+	for _, db := range o.replicas {
+		if e := db.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 func (o *ORM) AddTable(s interface{}) {
@@ -1347,7 +1495,7 @@ func (o *ORM) AddTable(s interface{}) {
 
 func (o *ORM) CheckTables() {
 	for _, s := range o.tables {
-		err := checkTableColumns(o.db, s)
+		err := checkTableColumns(o.context(), o.db, s)
 		if err != nil {
 			logrus.WithError(err).Fatal("Can not pass table check")
 		}
@@ -1364,7 +1512,7 @@ func (o *ORM) GetTableByName(name string) interface{} {
 }
 
 func (o *ORM) TruncateTable(t string) error {
-	_, err := o.db.Exec("truncate table " + t)
+	_, err := o.db.ExecContext(ensureContext(o.context()), "truncate table "+t)
 	return err
 }
 
@@ -1379,87 +1527,140 @@ func (o *ORM) TruncateTables() error {
 }
 
 func (o *ORM) Begin() (*ORMTran, error) {
-	tx, err := o.db.Begin()
-	return &ORMTran{
-		ctx: o.ctx,
-		tx:  tx,
-	}, err
+	return o.BeginTx(o.ctx, nil)
+}
+
+// BeginTx 使用指定的context和事务选项开始一个事务，opts为nil时使用数据库默认的隔离级别，
+// 例如 &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+func (o *ORM) BeginTx(c context.Context, opts *sql.TxOptions) (*ORMTran, error) {
+	c = o.withContext(c).context()
+	tx, err := o.db.BeginTx(ensureContext(c), opts)
+	tran := &ORMTran{
+		db:    o.db,
+		tx:    tx,
+		state: &tranState{},
+		opts:  opts,
+	}
+	//事务放入context中，使用这个context的ORM会自动加入事务
+	tran.ctx = context.WithValue(ensureContext(c), tranKey{}, tran)
+	return tran, err
+}
+
+// From 以s对应的表创建一个查询构造器
+func (o *ORM) From(s interface{}) *QueryBuilder {
+	return newQueryBuilder(o.context(), o.reader(), o.writer(), s)
 }
 
 func (o *ORM) SelectOne(s interface{}, query string, args ...interface{}) error {
-	return selectOne(o.ctx, o.db, s, query, args...)
+	return selectOne(o.context(), o.reader(), s, query, args...)
 }
 
-func (o *ORM) SelectByPK(s interface{}, pk interface{}) error {
-	return selectByPK(o.ctx, o.db, s, pk)
+// SelectByPK 通过主键查询，联合主键时按照struct中主键定义的顺序传入多个值
+func (o *ORM) SelectByPK(s interface{}, pks ...interface{}) error {
+	return selectByPK(o.context(), o.reader(), s, pks...)
 }
 
 func (o *ORM) Select(s interface{}, query string, args ...interface{}) error {
-	return selectMany(o.ctx, o.db, s, query, args...)
+	return selectMany(o.context(), o.reader(), s, query, args...)
 }
 
 func (o *ORM) SelectRawSet(query string, columnMaps map[string]string, args ...interface{}) ([]map[string]interface{}, error) {
-	return selectRawSet(o.ctx, o.db, query, columnMaps, args...)
+	return selectRawSet(o.context(), o.reader(), query, columnMaps, args...)
 }
 
 func (o *ORM) SelectRaw(query string, args ...interface{}) ([]string, [][]interface{}, error) {
-	return selectRaw(o.ctx, o.db, query, args...)
+	return selectRaw(o.context(), o.reader(), query, args...)
 }
 
 func (o *ORM) SelectRawWithParam(paramQuery string, paramMap interface{}) ([]string, [][]interface{}, error) {
-	return selectRawWithParam(o.ctx, o.db, paramQuery, paramMap)
+	return selectRawWithParam(o.context(), o.reader(), paramQuery, paramMap)
 }
 
 func (o *ORM) SelectRawSetWithParam(paramQuery string, paramMap interface{}) ([]map[string]interface{}, error) {
-	return selectRawSetWithParam(o.ctx, o.db, paramQuery, paramMap)
+	return selectRawSetWithParam(o.context(), o.reader(), paramQuery, paramMap)
 }
 
 func (o *ORM) SelectStr(query string, args ...interface{}) (string, error) {
-	return selectStr(o.ctx, o.db, query, args...)
+	return selectStr(o.context(), o.reader(), query, args...)
 }
 
 func (o *ORM) SelectInt(query string, args ...interface{}) (int64, error) {
-	return selectInt(o.ctx, o.db, query, args...)
+	return selectInt(o.context(), o.reader(), query, args...)
 }
 
 func (o *ORM) UpdateByPK(s interface{}) error {
-	return updateByPK(o.ctx, o.db, s)
+	return updateByPK(o.context(), o.writer(), s)
 }
 
-//在数据库字段和struct字段不是以驼峰表示法对应的时候就会报错，建议填入数据库对应的字段
+// UpdateFieldsByPK 只更新fields中的字段，fields可以是struct中的字段名或者数据库字段名
 func (o *ORM) UpdateFieldsByPK(s interface{}, fields []string) error {
-	return updateFieldsByPK(o.ctx, o.db, s, fields)
+	return updateFieldsByPK(o.context(), o.writer(), s, fields)
+}
+
+// UpdateChanged 只更新查询之后修改过的字段，没有修改时不执行sql，s需要嵌入DirtyTracker
+func (o *ORM) UpdateChanged(s interface{}) error {
+	return updateChanged(o.context(), o.writer(), s)
 }
 
 func (o *ORM) Insert(s interface{}) error {
-	return insert(o.ctx, o.db, s)
+	return insert(o.context(), o.writer(), s)
 }
 
 func (o *ORM) InsertWithTable(s interface{}, tableName string) error {
-	return insertByTable(o.ctx, o.db, tableName, s)
+	return insertByTable(o.context(), o.writer(), tableName, s)
+}
+
+// AddAssociation 在many_to_many关联的中间表中增加s和targets的关联，field为s中关联字段的名字，targets为关联表struct的指针
+func (o *ORM) AddAssociation(s interface{}, field string, targets ...interface{}) error {
+	return addAssociation(o.context(), o.writer(), s, field, targets...)
+}
+
+// RemoveAssociation 从many_to_many关联的中间表中删除s和targets的关联，返回删除的行数
+func (o *ORM) RemoveAssociation(s interface{}, field string, targets ...interface{}) (int64, error) {
+	return removeAssociation(o.context(), o.writer(), s, field, targets...)
 }
 
 func (o *ORM) InsertBatch(s []interface{}) error {
-	return insertBatch(o.ctx, o.db, s)
+	return insertBatch(o.context(), o.writer(), s)
 }
 
 func (o *ORM) InsertOrUpdate(s interface{}, keys []string) error {
-	return insertOrUpdate(o.ctx, o.db, s, keys)
+	return insertOrUpdate(o.context(), o.writer(), s, keys)
+}
+
+// DeleteByPK 根据s中主键的值删除记录
+func (o *ORM) DeleteByPK(s interface{}) error {
+	return deleteByPK(o.context(), o.writer(), s, false)
+}
+
+// DeleteByPKWithRowAffectCheck 根据主键删除记录，没有删除到正好一行时返回*RowAffectError
+func (o *ORM) DeleteByPKWithRowAffectCheck(s interface{}) error {
+	return deleteByPK(o.context(), o.writer(), s, true)
+}
+
+// DeleteByPKs 根据主键列表批量删除，sample用于确定表和主键，返回删除的行数
+func (o *ORM) DeleteByPKs(sample interface{}, pks interface{}) (int64, error) {
+	return deleteByPKs(o.context(), o.writer(), sample, pks)
+}
+
+// DeleteWhere 根据条件删除sample对应表中的记录，返回删除的行数
+func (o *ORM) DeleteWhere(sample interface{}, where string, args ...interface{}) (int64, error) {
+	return deleteWhere(o.context(), o.writer(), sample, where, args...)
 }
 
 func (o *ORM) ExecWithRowAffectCheck(n int64, query string, args ...interface{}) error {
-	return execWithRowAffectCheck(o.ctx, o.db, n, query, args...)
+	return execWithRowAffectCheck(o.context(), o.writer(), n, query, args...)
 }
 
 func (o *ORM) Exec(query string, args ...interface{}) (sql.Result, error) {
-	return exec(o.ctx, o.db, query, args...)
+	return exec(o.context(), o.writer(), query, args...)
 }
 func (o *ORM) Query(queryStr string, args ...interface{}) (*sql.Rows, error) {
-	return query(o.ctx, o.db, queryStr, args...)
+	return query(o.context(), o.writer(), queryStr, args...)
 }
 
 func (o *ORM) ExecWithParam(paramQuery string, paramMap interface{}) (sql.Result, error) {
-	return execWithParam(o.ctx, o.db, paramQuery, paramMap)
+	return execWithParam(o.context(), o.writer(), paramQuery, paramMap)
 }
 
 func getFieldValue(param interface{}, fieldName string) (interface{}, error) {
@@ -1473,7 +1674,7 @@ func getFieldValue(param interface{}, fieldName string) (interface{}, error) {
 		if f.IsValid() {
 			return f.Interface(), nil
 		} else {
-			return nil, errors.New("missing field " + fieldName)
+			return nil, &MissingFieldError{Field: fieldName}
 		}
 	} else if v.Kind() == reflect.Struct {
 		f := v.FieldByName(fieldName)
@@ -1482,15 +1683,31 @@ func getFieldValue(param interface{}, fieldName string) (interface{}, error) {
 		if f.IsValid() {
 			return f.Interface(), nil
 		} else {
-			return nil, errors.New("missing field " + fieldName)
+			return nil, &MissingFieldError{Field: fieldName}
 		}
 	} else {
 		return nil, errors.New(fmt.Sprintf("input interface type {%v} is not supported", v.Kind().String()))
 	}
 }
 
+// DoTransaction 在事务中执行f，f返回error或者panic时回滚，否则提交。
+// context中已经有事务时通过savepoint在该事务中执行，和ORMTran.DoTransaction一样
 func (o *ORM) DoTransaction(f func(*ORMTran) error) error {
-	trans, err := o.Begin()
+	return o.DoTransactionWithOptions(nil, f)
+}
+
+// DoTransactionWithOptions 和DoTransaction一样，但是使用opts指定事务的隔离级别和是否只读，
+// 加入context中已有的事务时opts不生效
+func (o *ORM) DoTransactionWithOptions(opts *sql.TxOptions, f func(*ORMTran) error) error {
+	if tran := tranFromContext(o.ctx, o.db); tran != nil {
+		return tran.DoTransaction(f)
+	}
+	return o.doNewTransaction(opts, f)
+}
+
+// 总是开始一个新的事务执行f，不加入context中的事务
+func (o *ORM) doNewTransaction(opts *sql.TxOptions, f func(*ORMTran) error) (err error) {
+	trans, err := o.BeginTx(o.ctx, opts)
 	if err != nil {
 		return err
 	}
@@ -1511,26 +1728,56 @@ func (o *ORM) DoTransaction(f func(*ORMTran) error) error {
 	return err
 }
 
-func (o *ORM) DoTransactionMore(f func(*ORMTran) (interface{}, error)) (interface{}, error) {
-	trans, err := o.Begin()
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		if err != nil {
-			trans.Rollback()
-			return
-		} else {
-			err = trans.Commit()
-			return
-		}
-	}()
-	return f(trans)
+// DoTransactionMore 和DoTransaction一样，f返回error或者panic时回滚，否则提交，并且返回f的结果
+func (o *ORM) DoTransactionMore(f func(*ORMTran) (interface{}, error)) (ret interface{}, err error) {
+	err = o.DoTransaction(func(ot *ORMTran) error {
+		var ferr error
+		ret, ferr = f(ot)
+		return ferr
+	})
+	return ret, err
 }
 
 type ORMTran struct {
-	ctx context.Context
-	tx  *sql.Tx
+	ctx           context.Context
+	db            *sql.DB
+	tx            *sql.Tx
+	preloads      []string
+	lockRelations bool
+	state         *tranState
+	opts          *sql.TxOptions
+}
+
+// Preload 指定事务中查询时需要加载的关联，用法和ORM.Preload一样
+func (o *ORMTran) Preload(paths ...string) *ORMTran {
+	no := new(ORMTran)
+	*no = *o
+	no.preloads = append(append(make([]string, 0, len(o.preloads)+len(paths)), o.preloads...), paths...)
+	no.ctx = withPreload(o.ctx, newPreloadTree(no.preloads))
+	return no
+}
+
+// WithContext 返回一个使用c执行sql的ORMTran，事务本身仍然受开始事务时的context控制
+func (o *ORMTran) WithContext(c context.Context) ORMer {
+	no := new(ORMTran)
+	*no = *o
+	//事务、logger、Unscoped和锁定的设置保存在context中，需要带到c中
+	c = ensureContext(c)
+	for _, key := range []interface{}{tranKey{}, loggerKey{}, unscopedKey{}, lockKey{}} {
+		if v := ensureContext(o.ctx).Value(key); v != nil {
+			c = context.WithValue(c, key, v)
+		}
+	}
+	if no.preloads != nil {
+		c = withPreload(c, newPreloadTree(no.preloads))
+	}
+	no.ctx = c
+	return no
+}
+
+// From 以s对应的表创建一个在事务中执行的查询构造器
+func (o *ORMTran) From(s interface{}) *QueryBuilder {
+	return newQueryBuilder(o.ctx, o.tx, o.tx, s)
 }
 
 func (o *ORMTran) SelectOne(s interface{}, query string, args ...interface{}) error {
@@ -1541,6 +1788,10 @@ func (o *ORMTran) Insert(s interface{}) error {
 	return insert(o.ctx, o.tx, s)
 }
 
+func (o *ORMTran) InsertWithTable(s interface{}, tableName string) error {
+	return insertByTable(o.ctx, o.tx, tableName, s)
+}
+
 func (o *ORMTran) InsertOrUpdate(s interface{}, keys []string) error {
 	return insertOrUpdate(o.ctx, o.tx, s, keys)
 }
@@ -1553,10 +1804,15 @@ func (o *ORMTran) UpdateByPK(s interface{}) error {
 	return updateByPK(o.ctx, o.tx, s)
 }
 
-//在数据库字段和struct字段不是以驼峰表示法对应的时候就会报错，建议填入数据库对应的字段
+// UpdateFieldsByPK 只更新fields中的字段，fields可以是struct中的字段名或者数据库字段名
 func (o *ORMTran) UpdateFieldsByPK(s interface{}, fields []string) error {
 	return updateFieldsByPK(o.ctx, o.tx, s, fields)
 }
+
+// UpdateChanged 只更新查询之后修改过的字段，用法和ORM.UpdateChanged一样
+func (o *ORMTran) UpdateChanged(s interface{}) error {
+	return updateChanged(o.ctx, o.tx, s)
+}
 func (o *ORMTran) Exec(query string, args ...interface{}) (sql.Result, error) {
 	return exec(o.ctx, o.tx, query, args...)
 }
@@ -1566,21 +1822,57 @@ func (o *ORMTran) Query(queryStr string, args ...interface{}) (*sql.Rows, error)
 }
 
 func (o *ORMTran) Commit() error {
-	return o.tx.Commit()
+	err := o.tx.Commit()
+	o.state.done = true
+	if err != nil {
+		return err
+	}
+	o.state.runHooks(true)
+	return nil
 }
 
 func (o *ORMTran) Rollback() error {
-	return o.tx.Rollback()
+	err := o.tx.Rollback()
+	o.state.done = true
+	if err != nil {
+		return err
+	}
+	o.state.runHooks(false)
+	return nil
 }
 
-func (o *ORMTran) SelectByPK(s interface{}, pk interface{}) error {
-	return selectByPK(o.ctx, o.tx, s, pk)
+// Options 事务开始时使用的选项，没有指定时返回零值，即数据库默认的隔离级别并且可写
+func (o *ORMTran) Options() sql.TxOptions {
+	if o.opts == nil {
+		return sql.TxOptions{}
+	}
+	return *o.opts
+}
+
+func (o *ORMTran) SelectByPK(s interface{}, pks ...interface{}) error {
+	return selectByPK(o.ctx, o.tx, s, pks...)
 }
 
 func (o *ORMTran) Select(s interface{}, query string, args ...interface{}) error {
 	return selectMany(o.ctx, o.tx, s, query, args...)
 }
 
+func (o *ORMTran) SelectRaw(query string, args ...interface{}) ([]string, [][]interface{}, error) {
+	return selectRaw(o.ctx, o.tx, query, args...)
+}
+
+func (o *ORMTran) SelectRawSet(query string, columnMaps map[string]string, args ...interface{}) ([]map[string]interface{}, error) {
+	return selectRawSet(o.ctx, o.tx, query, columnMaps, args...)
+}
+
+func (o *ORMTran) SelectRawWithParam(paramQuery string, paramMap interface{}) ([]string, [][]interface{}, error) {
+	return selectRawWithParam(o.ctx, o.tx, paramQuery, paramMap)
+}
+
+func (o *ORMTran) SelectRawSetWithParam(paramQuery string, paramMap interface{}) ([]map[string]interface{}, error) {
+	return selectRawSetWithParam(o.ctx, o.tx, paramQuery, paramMap)
+}
+
 func (o *ORMTran) SelectInt(query string, args ...interface{}) (int64, error) {
 	return selectInt(o.ctx, o.tx, query, args...)
 }
@@ -1593,6 +1885,32 @@ func (o *ORMTran) ExecWithParam(paramQuery string, paramMap interface{}) (sql.Re
 	return execWithParam(o.ctx, o.tx, paramQuery, paramMap)
 }
 
+func (o *ORMTran) DeleteByPK(s interface{}) error {
+	return deleteByPK(o.ctx, o.tx, s, false)
+}
+
+func (o *ORMTran) DeleteByPKWithRowAffectCheck(s interface{}) error {
+	return deleteByPK(o.ctx, o.tx, s, true)
+}
+
+func (o *ORMTran) DeleteByPKs(sample interface{}, pks interface{}) (int64, error) {
+	return deleteByPKs(o.ctx, o.tx, sample, pks)
+}
+
+func (o *ORMTran) DeleteWhere(sample interface{}, where string, args ...interface{}) (int64, error) {
+	return deleteWhere(o.ctx, o.tx, sample, where, args...)
+}
+
+// AddAssociation 在many_to_many关联的中间表中增加s和targets的关联，field为s中关联字段的名字，targets为关联表struct的指针
+func (o *ORMTran) AddAssociation(s interface{}, field string, targets ...interface{}) error {
+	return addAssociation(o.ctx, o.tx, s, field, targets...)
+}
+
+// RemoveAssociation 从many_to_many关联的中间表中删除s和targets的关联，返回删除的行数
+func (o *ORMTran) RemoveAssociation(s interface{}, field string, targets ...interface{}) (int64, error) {
+	return removeAssociation(o.ctx, o.tx, s, field, targets...)
+}
+
 func (o *ORMTran) ExecWithRowAffectCheck(n int64, query string, args ...interface{}) error {
 	return execWithRowAffectCheck(o.ctx, o.tx, n, query, args...)
 }
@@ -1635,7 +1953,3 @@ func NormalizeValue(valueType string, value interface{}) (interface{}, error) {
 	}
 	return value, nil
 }
-
-func IsRowAffectError(err error) bool {
-	return strings.HasPrefix(err.Error(), "[RowAffectCheckError]")
-}
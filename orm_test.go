@@ -1,10 +1,13 @@
 package orm
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"testing"
 	"time"
 
@@ -45,6 +48,28 @@ type TestOrmD222 struct {
 	Name       string
 }
 
+// 和TestOrmD222使用同一个表，用于测试多级的Preload
+type TestOrmDWithA struct {
+	TestOrmDId int64 `pk:"true" ai:"true"`
+	Name       string
+	OrmAs      []*TestOrmA123 `or:"has_many" table:"test_orm_a123"`
+	BCount     int            `ignore:"true"`
+}
+
+func (d TestOrmDWithA) TableName() string {
+	return "test_orm_d222"
+}
+
+// hook中查询其他类型时不会使用调用方的Preload
+func (d *TestOrmDWithA) AfterFind(c context.Context, tdx Tdx) error {
+	var bs []*TestOrmB999
+	if err := selectMany(c, tdx, &bs, "select * from test_orm_b999"); err != nil {
+		return err
+	}
+	d.BCount = len(bs)
+	return nil
+}
+
 type TestOrmE333 struct {
 	TestOrmEId  int64 `pk:"true" ai:"true"`
 	Name        string
@@ -69,6 +94,75 @@ func (obj TestOrmF123) TableName() string {
 	return "orm_f"
 }
 
+type TestOrmG444 struct {
+	TestID     int64 `db:"test_id,pk"`
+	TestOrmDId int64 `pk:"true"`
+	Role       string
+	OrmHs      []*TestOrmH555 `or:"has_many" table:"test_orm_h555"`
+}
+
+type TestOrmH555 struct {
+	TestOrmHId int64 `pk:"true" ai:"true"`
+	TestID     int64 `db:"test_id"`
+	TestOrmDId int64
+	Name       string
+}
+
+type TestOrmK888 struct {
+	TestOrmKId int64 `pk:"true" ai:"true"`
+	Name       string
+	OrmLs      []*TestOrmL999 `or:"many_to_many" table:"test_orm_l999" join_table:"test_orm_k_l" join_fk:"k_id" join_ref:"l_id"`
+}
+
+type TestOrmL999 struct {
+	TestOrmLId int64 `pk:"true" ai:"true"`
+	Name       string
+}
+
+type TestOrmUser struct {
+	ID    int64 `db:"id,pk,ai"`
+	Name  string
+	Posts []*TestOrmPost `or:"has_many" table:"test_orm_post" fk:"author_id"`
+}
+
+type TestOrmPost struct {
+	ID       int64 `db:"id,pk,ai"`
+	AuthorID int64 `db:"author_id"`
+	Title    string
+	Author   *TestOrmUser `or:"belongs_to" table:"test_orm_user" fk:"author_id" ref:"id"`
+}
+
+// 实现了driver.Valuer的业务编码，数据库中统一存储为大写
+type TestBizCode string
+
+func (c TestBizCode) Value() (driver.Value, error) {
+	return strings.ToUpper(string(c)), nil
+}
+
+func (c *TestBizCode) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		*c = TestBizCode(v)
+	case string:
+		*c = TestBizCode(v)
+	default:
+		return fmt.Errorf("unsupported biz code %v", src)
+	}
+	return nil
+}
+
+type TestOrmI666 struct {
+	Code  TestBizCode `pk:"true"`
+	Name  string
+	OrmJs []*TestOrmJ777 `or:"has_many" table:"test_orm_j777"`
+}
+
+type TestOrmJ777 struct {
+	TestOrmJId uint64 `pk:"true" ai:"true"`
+	Code       string
+	Name       string
+}
+
 func oneTestScope(fn func(orm *ORM, testTableName string)) {
 	orm := NewORM("root@/orm_test?parseTime=true&loc=Local")
 	orm.TruncateTables()
@@ -158,12 +252,173 @@ func oneTestScope(fn func(orm *ORM, testTableName string)) {
 		log.Printf("error %+v\n", err)
 	}
 
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_g444 (
+		test_id BIGINT NOT NULL,
+		test_orm_d_id BIGINT NOT NULL,
+		role VARCHAR(64) NOT NULL,
+		primary key (test_id, test_orm_d_id)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_h555 (
+		test_orm_h_id BIGINT NOT NULL AUTO_INCREMENT,
+		test_id BIGINT NOT NULL,
+		test_orm_d_id BIGINT NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		primary key (test_orm_h_id),
+		INDEX test_id (test_id, test_orm_d_id)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_i666 (
+		code VARCHAR(64) NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		primary key (code)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_j777 (
+		test_orm_j_id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+		code VARCHAR(64) NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		primary key (test_orm_j_id),
+		INDEX code (code)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_k888 (
+		test_orm_k_id BIGINT NOT NULL AUTO_INCREMENT,
+		name VARCHAR(64) NOT NULL,
+		primary key (test_orm_k_id)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_l999 (
+		test_orm_l_id BIGINT NOT NULL AUTO_INCREMENT,
+		name VARCHAR(64) NOT NULL,
+		primary key (test_orm_l_id)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_k_l (
+		k_id BIGINT NOT NULL,
+		l_id BIGINT NOT NULL,
+		primary key (k_id, l_id)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_user (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		name VARCHAR(64) NOT NULL,
+		primary key (id)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_post (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		author_id BIGINT NOT NULL,
+		title VARCHAR(64) NOT NULL,
+		primary key (id),
+		INDEX author_id (author_id)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_comment (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		post_id BIGINT NOT NULL,
+		content VARCHAR(64) NOT NULL,
+		deleted_at DATETIME NULL DEFAULT NULL,
+		primary key (id),
+		INDEX post_id (post_id)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_account (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		name VARCHAR(64) NOT NULL,
+		balance BIGINT NOT NULL DEFAULT 0,
+		version INT NOT NULL DEFAULT 0,
+		primary key (id),
+		UNIQUE KEY name (name)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
+	_, err = orm.Exec(`
+	CREATE TABLE IF NOT EXISTS test_orm_event (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		name VARCHAR(64) NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		primary key (id),
+		UNIQUE KEY name (name)
+	)
+	`)
+	if err != nil {
+		log.Printf("error %+v\n", err)
+	}
+
 	defer orm.Exec("DROP TABLE IF EXISTS test_orm_b999;")
 	defer orm.Exec("DROP TABLE IF EXISTS test_orm_a123;")
 	defer orm.Exec("DROP TABLE IF EXISTS test_orm_c111;")
 	defer orm.Exec("DROP TABLE IF EXISTS test_orm_d222;")
 	defer orm.Exec("DROP TABLE IF EXISTS test_orm_e333;")
 	defer orm.Exec("DROP TABLE IF EXISTS orm_f;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_g444;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_h555;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_i666;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_j777;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_k888;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_l999;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_k_l;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_user;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_post;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_comment;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_account;")
+	defer orm.Exec("DROP TABLE IF EXISTS test_orm_event;")
 	fn(orm, "test_orm_a123")
 }
 func TestSelectArr(t *testing.T) {
@@ -1213,3 +1468,686 @@ func TestTableName(t *testing.T) {
 		t.Log(result)
 	})
 }
+
+// 在第一次打印sql日志时取消context，用来模拟查询过程中客户端断开
+type cancelSqlLogger struct {
+	cancel context.CancelFunc
+}
+
+func (l *cancelSqlLogger) Log(c context.Context, sqlLog *SqlLog) {
+	l.cancel()
+}
+
+func (l *cancelSqlLogger) ShowExplain(dur time.Duration) bool {
+	return false
+}
+
+func TestContextCancel(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		testObjD := &TestOrmD222{Name: "test d"}
+		if err := orm.Insert(testObjD); err != nil {
+			t.Fatal(err)
+		}
+		testObj := &TestOrmA123{
+			OtherId:     1,
+			TestOrmDId:  testObjD.TestOrmDId,
+			Description: "test orm",
+			StartDate:   time.Now(),
+			EndDate:     time.Now(),
+		}
+		if err := orm.Insert(testObj); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			orm.Insert(&TestOrmC111{Name: fmt.Sprintf("orm_c_%d", i), TestID: testObj.TestID})
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		co := orm.WithContext(ctx)
+
+		var list []*TestOrmA123
+		if err := co.Select(&list, "select * from test_orm_a123"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("select should be canceled, got %v", err)
+		}
+		var one TestOrmA123
+		if err := co.SelectOne(&one, "select * from test_orm_a123 where test_id = ?", testObj.TestID); !errors.Is(err, context.Canceled) {
+			t.Fatalf("select one should be canceled, got %v", err)
+		}
+		called := false
+		err := co.DoTransaction(func(ot *ORMTran) error {
+			called = true
+			return nil
+		})
+		if !errors.Is(err, context.Canceled) || called {
+			t.Fatalf("transaction should not start with a canceled context, got %v", err)
+		}
+
+		//父对象查询成功后取消，关联的加载必须被中断
+		defer SetLog(&VerboseSqlLogger{})
+		ctx, cancel = context.WithCancel(context.Background())
+		SetLog(&cancelSqlLogger{cancel: cancel})
+		one = TestOrmA123{}
+		err = orm.WithContext(ctx).SelectOne(&one, "select * from test_orm_a123 where test_id = ?", testObj.TestID)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("relation loading should be canceled, got %v", err)
+		}
+		ctx, cancel = context.WithCancel(context.Background())
+		SetLog(&cancelSqlLogger{cancel: cancel})
+		list = nil
+		err = orm.WithContext(ctx).Select(&list, "select * from test_orm_a123")
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("relation loading should be canceled, got %v", err)
+		}
+		SetLog(&VerboseSqlLogger{})
+
+		//事务中途取消，已经执行的sql需要回滚
+		ctx, cancel = context.WithCancel(context.Background())
+		err = orm.WithContext(ctx).DoTransaction(func(ot *ORMTran) error {
+			if _, err := ot.Exec("update test_orm_a123 set description = 'canceled'"); err != nil {
+				return err
+			}
+			cancel()
+			_, err := ot.Exec("update test_orm_d222 set name = 'canceled'")
+			return err
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("transaction should be canceled, got %v", err)
+		}
+		one = TestOrmA123{}
+		if err := orm.SelectByPK(&one, testObj.TestID); err != nil {
+			t.Fatal(err)
+		}
+		if one.Description != "test orm" {
+			t.Fatal("canceled transaction should be rolled back")
+		}
+	})
+}
+
+func TestDeleteByPK(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		ids := make([]int64, 0)
+		for i := 0; i < 5; i++ {
+			obj := &TestOrmF123{Name: fmt.Sprintf("f%d", i)}
+			if err := orm.Insert(obj); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, obj.Id)
+		}
+		if err := orm.DeleteByPK(&TestOrmF123{Id: ids[0]}); err != nil {
+			t.Fatal(err)
+		}
+		var loaded TestOrmF123
+		if err := orm.SelectByPK(&loaded, ids[0]); err != sql.ErrNoRows {
+			t.Fatal("record should be deleted", err)
+		}
+		err := orm.DeleteByPKWithRowAffectCheck(&TestOrmF123{Id: ids[0]})
+		if err == nil || !IsRowAffectError(err) {
+			t.Fatal("should return row affect error", err)
+		}
+
+		n, err := orm.DeleteByPKs(&TestOrmF123{}, ids[1:3])
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, n, int64(2))
+		//数组和slice一样处理，已经删除的记录不会再次删除
+		n, err = orm.DeleteByPKs(&TestOrmF123{}, [2]int64{ids[1], ids[2]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, n, int64(0))
+
+		err = orm.DoTransaction(func(ot *ORMTran) error {
+			n, err := ot.DeleteWhere(TestOrmF123{}, "name = ?", "f3")
+			assert.Equal(t, n, int64(1))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := orm.DeleteWhere(&TestOrmF123{}, ""); err == nil {
+			t.Fatal("delete without where should fail")
+		}
+		cnt, err := orm.SelectInt("select count(*) from orm_f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cnt, int64(1))
+	})
+}
+
+func TestCompositePrimaryKey(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		for i := int64(1); i <= 3; i++ {
+			if err := orm.Insert(&TestOrmG444{TestID: 1, TestOrmDId: i, Role: "member"}); err != nil {
+				t.Fatal(err)
+			}
+			orm.Insert(&TestOrmH555{TestID: 1, TestOrmDId: i, Name: fmt.Sprintf("h%d", i)})
+		}
+		orm.Insert(&TestOrmH555{TestID: 2, TestOrmDId: 1, Name: "other"})
+
+		var g TestOrmG444
+		if err := orm.SelectByPK(&g, 1, 2); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, g.Role, "member")
+		assert.Equal(t, len(g.OrmHs), 1)
+		assert.Equal(t, g.OrmHs[0].Name, "h2")
+		if err := orm.SelectByPK(&g, 1); err == nil {
+			t.Fatal("should require all primary keys")
+		}
+
+		g.Role = "owner"
+		if err := orm.UpdateByPK(&g); err != nil {
+			t.Fatal(err)
+		}
+		g3 := &TestOrmG444{TestID: 1, TestOrmDId: 3, Role: "admin"}
+		if err := orm.UpdateFieldsByPK(g3, []string{"Role"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := orm.InsertOrUpdate(&TestOrmG444{TestID: 1, TestOrmDId: 1, Role: "guest"}, []string{"role"}); err != nil {
+			t.Fatal(err)
+		}
+
+		var list []*TestOrmG444
+		if err := orm.Select(&list, "select * from test_orm_g444 order by test_orm_d_id"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(list), 3)
+		assert.Equal(t, list[0].Role, "guest")
+		assert.Equal(t, list[1].Role, "owner")
+		assert.Equal(t, list[2].Role, "admin")
+		for _, item := range list {
+			assert.Equal(t, len(item.OrmHs), 1)
+			assert.Equal(t, item.OrmHs[0].TestOrmDId, item.TestOrmDId)
+		}
+
+		if err := orm.DeleteByPK(&TestOrmG444{TestID: 1, TestOrmDId: 1}); err != nil {
+			t.Fatal(err)
+		}
+		n, err := orm.DeleteByPKs(&TestOrmG444{}, [][]int64{{1, 2}, {1, 3}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, n, int64(2))
+	})
+}
+
+func TestNonIntegerPrimaryKey(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		obj := &TestOrmI666{Code: "a'b", Name: "quoted"}
+		if err := orm.Insert(obj); err != nil {
+			t.Fatal(err)
+		}
+		j := &TestOrmJ777{Code: "A'B", Name: "child"}
+		if err := orm.Insert(j); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, j.TestOrmJId, uint64(1))
+		list := []interface{}{&TestOrmJ777{Code: "A'B", Name: "c2"}, &TestOrmJ777{Code: "other", Name: "c3"}}
+		if err := orm.InsertBatch(list); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, list[1].(*TestOrmJ777).TestOrmJId, uint64(3))
+
+		obj.Name = "updated"
+		if err := orm.UpdateByPK(obj); err != nil {
+			t.Fatal(err)
+		}
+		var loaded TestOrmI666
+		if err := orm.SelectByPK(&loaded, obj.Code); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.Code, TestBizCode("A'B"))
+		assert.Equal(t, loaded.Name, "updated")
+		assert.Equal(t, len(loaded.OrmJs), 2)
+
+		loaded.Name = "fields"
+		if err := orm.UpdateFieldsByPK(&loaded, []string{"Name"}); err != nil {
+			t.Fatal(err)
+		}
+		var all []*TestOrmI666
+		if err := orm.Select(&all, "select * from test_orm_i666"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(all), 1)
+		assert.Equal(t, all[0].Name, "fields")
+		assert.Equal(t, len(all[0].OrmJs), 2)
+
+		if err := orm.DeleteByPKWithRowAffectCheck(obj); err != nil {
+			t.Fatal(err)
+		}
+		n, err := orm.DeleteByPKs(&TestOrmJ777{}, []uint64{1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, n, int64(3))
+	})
+}
+
+func BenchmarkSelect2000Rows(b *testing.B) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		list := make([]interface{}, 0, 2000)
+		for i := 0; i < 2000; i++ {
+			list = append(list, &TestOrmB999{
+				NoAiId:      int64(i + 1),
+				Description: "test orm 1测试",
+				TestID:      int64(i),
+			})
+		}
+		if err := orm.InsertBatch(list); err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var res []*TestOrmB999
+			if err := orm.Select(&res, "select * from test_orm_b999 limit 2000"); err != nil {
+				b.Fatal(err)
+			}
+			if len(res) != 2000 {
+				b.Fatalf("expect 2000 rows, got %d", len(res))
+			}
+		}
+	})
+}
+
+func BenchmarkColumnsByStruct(b *testing.B) {
+	obj := &TestOrmA123{Description: "test orm 1测试", StartDate: time.Now()}
+	for i := 0; i < b.N; i++ {
+		columnsByStruct(obj)
+	}
+}
+
+func TestRelationChunk(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		SetRelationChunkSize(2)
+		defer SetRelationChunkSize(1000)
+		testObjD := &TestOrmD222{Name: "test d"}
+		if err := orm.Insert(testObjD); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			a := &TestOrmA123{OtherId: int64(i), TestOrmDId: testObjD.TestOrmDId, Description: "chunk", StartDate: time.Now()}
+			if err := orm.Insert(a); err != nil {
+				t.Fatal(err)
+			}
+			orm.Insert(&TestOrmB999{NoAiId: a.TestID, TestID: a.TestID, Description: "chunk"})
+			orm.Insert(&TestOrmC111{Name: "c1", TestID: a.TestID})
+			orm.Insert(&TestOrmC111{Name: "c2", TestID: a.TestID})
+		}
+		var list []*TestOrmA123
+		if err := orm.Select(&list, "select * from test_orm_a123"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(list), 5)
+		for _, a := range list {
+			if a.OrmB == nil || a.OrmB.TestID != a.TestID || a.OrmD == nil || len(a.OrmCs) != 2 {
+				t.Fatalf("incorrect relations of %d", a.TestID)
+			}
+		}
+	})
+}
+
+func TestRelationWithoutLimit(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		//关联的查询不会自动加LIMIT 2000
+		user := &TestOrmUser{Name: "u"}
+		if err := orm.Insert(user); err != nil {
+			t.Fatal(err)
+		}
+		k := &TestOrmK888{Name: "k"}
+		if err := orm.Insert(k); err != nil {
+			t.Fatal(err)
+		}
+		posts := make([]interface{}, 0, 2001)
+		ls := make([]interface{}, 0, 2001)
+		for i := 0; i < 2001; i++ {
+			posts = append(posts, &TestOrmPost{AuthorID: user.ID, Title: fmt.Sprintf("post %d", i)})
+			ls = append(ls, &TestOrmL999{Name: fmt.Sprintf("l %d", i)})
+		}
+		if err := orm.InsertBatch(posts); err != nil {
+			t.Fatal(err)
+		}
+		if err := orm.InsertBatch(ls); err != nil {
+			t.Fatal(err)
+		}
+		if err := orm.AddAssociation(k, "OrmLs", ls...); err != nil {
+			t.Fatal(err)
+		}
+
+		var u TestOrmUser
+		if err := orm.SelectByPK(&u, user.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(u.Posts), 2001)
+		var k2 TestOrmK888
+		if err := orm.SelectByPK(&k2, k.TestOrmKId); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(k2.OrmLs), 2001)
+	})
+}
+
+func TestNormalizeKey(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, relationKey([]interface{}{now}), relationKey([]interface{}{now.UTC().Round(0)}))
+	assert.Equal(t, relationKey([]interface{}{[]byte("abc")}), relationKey([]interface{}{"abc"}))
+	assert.Equal(t, relationKey([]interface{}{uint32(7)}), relationKey([]interface{}{int64(7)}))
+	assert.Equal(t, relationKey([]interface{}{sql.NullInt64{Int64: 7, Valid: true}}), relationKey([]interface{}{int64(7)}))
+	assert.Equal(t, relationKey([]interface{}{sql.NullInt64{}}), nil)
+}
+
+func TestManyToManyRelation(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		ks := []*TestOrmK888{{Name: "k1"}, {Name: "k2"}, {Name: "k3"}}
+		ls := []*TestOrmL999{{Name: "l1"}, {Name: "l2"}, {Name: "l3"}}
+		for i := range ks {
+			if err := orm.Insert(ks[i]); err != nil {
+				t.Fatal(err)
+			}
+			if err := orm.Insert(ls[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := orm.DoTransaction(func(ot *ORMTran) error {
+			if err := ot.AddAssociation(ks[0], "OrmLs", ls[0], ls[1], ls[2]); err != nil {
+				return err
+			}
+			if err := ot.AddAssociation(ks[1], "OrmLs", ls[1]); err != nil {
+				return err
+			}
+			n, err := ot.RemoveAssociation(ks[0], "OrmLs", ls[2])
+			assert.Equal(t, n, int64(1))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var k TestOrmK888
+		if err := orm.SelectByPK(&k, ks[0].TestOrmKId); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(k.OrmLs), 2)
+
+		var list []*TestOrmK888
+		if err := orm.Select(&list, "select * from test_orm_k888 order by test_orm_k_id"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(list), 3)
+		assert.Equal(t, len(list[0].OrmLs), 2)
+		assert.Equal(t, len(list[1].OrmLs), 1)
+		assert.Equal(t, list[1].OrmLs[0].Name, "l2")
+		assert.Equal(t, len(list[2].OrmLs), 0)
+
+		err = orm.DoTransaction(func(ot *ORMTran) error {
+			return ot.AddAssociation(ks[0], "Name", ls[0])
+		})
+		if err == nil {
+			t.Fatal("should not add association to a non many_to_many field")
+		}
+	})
+}
+
+func TestPreload(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		testObjD := &TestOrmD222{Name: "test d"}
+		if err := orm.Insert(testObjD); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			a := &TestOrmA123{OtherId: int64(i), TestOrmDId: testObjD.TestOrmDId, Description: "preload", StartDate: time.Now()}
+			if err := orm.Insert(a); err != nil {
+				t.Fatal(err)
+			}
+			orm.Insert(&TestOrmB999{NoAiId: a.TestID, TestID: a.TestID, Description: "preload"})
+			orm.Insert(&TestOrmC111{Name: "c1", TestID: a.TestID})
+			orm.Insert(&TestOrmC111{Name: "c2", TestID: a.TestID})
+		}
+
+		var list []*TestOrmA123
+		if err := orm.Preload("OrmD").Select(&list, "select * from test_orm_a123"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(list), 2)
+		for _, a := range list {
+			if a.OrmB != nil || a.OrmCs != nil || a.OrmD == nil {
+				t.Fatal("should only load OrmD")
+			}
+		}
+
+		var ds []*TestOrmDWithA
+		if err := orm.Preload("OrmAs.OrmCs", "OrmAs.OrmD").Select(&ds, "select * from test_orm_d222"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(ds), 1)
+		assert.Equal(t, len(ds[0].OrmAs), 2)
+		assert.Equal(t, ds[0].BCount, 2)
+		for _, da := range ds[0].OrmAs {
+			if len(da.OrmCs) != 2 || da.OrmCs[0].TestID != da.TestID || da.OrmD == nil || da.OrmB != nil {
+				t.Fatal("should load OrmAs.OrmCs and OrmAs.OrmD")
+			}
+		}
+
+		var one TestOrmA123
+		if err := orm.Preload().SelectOne(&one, "select * from test_orm_a123"); err != nil {
+			t.Fatal(err)
+		}
+		if one.OrmB != nil || one.OrmCs != nil || one.OrmD != nil {
+			t.Fatal("should not load any relation")
+		}
+
+		//默认加载所有关联，但是只加载一层
+		list = nil
+		if err := orm.Select(&list, "select * from test_orm_a123"); err != nil {
+			t.Fatal(err)
+		}
+		if list[0].OrmB == nil || list[0].OrmD == nil || len(list[0].OrmCs) != 2 {
+			t.Fatal("should load one level of relations by default")
+		}
+
+		err := orm.DoTransaction(func(ot *ORMTran) error {
+			var d TestOrmDWithA
+			if err := ot.Preload("OrmAs.OrmB").SelectOne(&d, "select * from test_orm_d222"); err != nil {
+				return err
+			}
+			if len(d.OrmAs) != 2 || d.OrmAs[0].OrmB == nil || d.OrmAs[0].OrmCs != nil {
+				t.Fatal("should load OrmAs.OrmB in transaction")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := orm.Preload("Unknown").Select(&list, "select * from test_orm_a123"); err == nil {
+			t.Fatal("should fail for unknown relation")
+		}
+		if err := orm.Preload("OrmD.Unknown").Select(&list, "select * from test_orm_a123"); err == nil {
+			t.Fatal("should fail for unknown nested relation")
+		}
+	})
+}
+
+func TestSelectForUpdate(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		testObjD := &TestOrmD222{Name: "test d"}
+		if err := orm.Insert(testObjD); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			a := &TestOrmA123{OtherId: int64(i), TestOrmDId: testObjD.TestOrmDId, Description: "lock", StartDate: time.Now()}
+			if err := orm.Insert(a); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := orm.DoTransaction(func(ot *ORMTran) error {
+			var d TestOrmDWithA
+			if err := ot.SelectOneForUpdate(&d, "select * from test_orm_d222 where test_orm_d_id = ?", testObjD.TestOrmDId); err != nil {
+				return err
+			}
+			assert.Equal(t, d.Name, "test d")
+			assert.Equal(t, len(d.OrmAs), 2)
+
+			var list []*TestOrmA123
+			if err := ot.LockRelations().SelectForUpdate(&list, "select * from test_orm_a123 where test_orm_d_id = ? for update", testObjD.TestOrmDId); err != nil {
+				return err
+			}
+			assert.Equal(t, len(list), 2)
+			assert.Equal(t, list[0].OrmD.TestOrmDId, testObjD.TestOrmDId)
+
+			var shared []*TestOrmD222
+			if err := ot.SelectInShareMode(&shared, "select * from test_orm_d222"); err != nil {
+				return err
+			}
+			assert.Equal(t, len(shared), 1)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestNestedTransaction(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		err := orm.DoTransaction(func(ot *ORMTran) error {
+			if err := ot.Insert(&TestOrmD222{Name: "outer"}); err != nil {
+				return err
+			}
+			err := ot.DoTransaction(func(inner *ORMTran) error {
+				if err := inner.Insert(&TestOrmD222{Name: "rollback"}); err != nil {
+					return err
+				}
+				return errors.New("rollback inner")
+			})
+			assert.Equal(t, err.Error(), "rollback inner")
+
+			func() {
+				defer func() {
+					assert.Equal(t, recover(), "panic inner")
+				}()
+				ot.DoTransaction(func(inner *ORMTran) error {
+					inner.Insert(&TestOrmD222{Name: "panic"})
+					panic("panic inner")
+				})
+			}()
+
+			return ot.DoTransaction(func(inner *ORMTran) error {
+				return inner.DoTransaction(func(inner2 *ORMTran) error {
+					return inner2.Insert(&TestOrmD222{Name: "inner"})
+				})
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		rows, err := orm.Query("select name from test_orm_d222 order by test_orm_d_id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			rows.Scan(&name)
+			names = append(names, name)
+		}
+		assert.Equal(t, names, []string{"outer", "inner"})
+	})
+}
+
+// 只依赖ORMer的代码，在事务内外都可以执行
+func insertAndCountByORMer(t *testing.T, o ORMer, name string) int64 {
+	if err := o.InsertWithTable(&TestOrmD222{Name: name}, "test_orm_d222"); err != nil {
+		t.Fatal(err)
+	}
+	cols, rows, err := o.SelectRaw("select name from test_orm_d222 where name = ?", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, cols, []string{"name"})
+	assert.Equal(t, len(rows), 1)
+	set, err := o.SelectRawSetWithParam("select name from test_orm_d222 where name = #{name}", map[string]interface{}{"name": name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(set), 1)
+	_, rows, err = o.SelectRawWithParam("select name from test_orm_d222 where name = #{name}", map[string]interface{}{"name": name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(rows), 1)
+	set, err = o.WithContext(context.Background()).SelectRawSet("select name from test_orm_d222", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(set))
+}
+
+func TestORMerParity(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		assert.Equal(t, insertAndCountByORMer(t, orm, "outside"), int64(1))
+		err := orm.DoTransaction(func(ot *ORMTran) error {
+			assert.Equal(t, insertAndCountByORMer(t, ot, "inside"), int64(2))
+			return errors.New("rollback")
+		})
+		assert.Equal(t, err.Error(), "rollback")
+		cnt, err := orm.SelectInt("select count(*) from test_orm_d222")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cnt, int64(1))
+
+		//WithContext返回的ORMer可以转换回*ORM
+		if _, ok := orm.WithContext(context.Background()).(*ORM); !ok {
+			t.Fatal("WithContext of ORM should return *ORM")
+		}
+	})
+}
+
+func TestRelationForeignKeyTags(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		users := []*TestOrmUser{{Name: "u1"}, {Name: "u2"}}
+		for _, u := range users {
+			if err := orm.Insert(u); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 3; i++ {
+			if err := orm.Insert(&TestOrmPost{AuthorID: users[0].ID, Title: fmt.Sprintf("p%d", i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := orm.Insert(&TestOrmPost{AuthorID: users[1].ID, Title: "p3"}); err != nil {
+			t.Fatal(err)
+		}
+
+		var posts []*TestOrmPost
+		if err := orm.Select(&posts, "select * from test_orm_post order by id"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(posts), 4)
+		for _, p := range posts {
+			if p.Author == nil || p.Author.ID != p.AuthorID {
+				t.Fatal("belongs_to with fk and ref tags should be loaded")
+			}
+		}
+
+		var u TestOrmUser
+		if err := orm.SelectByPK(&u, users[0].ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(u.Posts), 3)
+
+		var list []*TestOrmUser
+		if err := orm.Preload("Posts.Author").Select(&list, "select * from test_orm_user order by id"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(list[0].Posts), 3)
+		assert.Equal(t, len(list[1].Posts), 1)
+		assert.Equal(t, list[1].Posts[0].Author.Name, "u2")
+	})
+}
@@ -0,0 +1,385 @@
+package orm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// 需要加载的关联，key为关联字段的名字，value为该关联下需要继续加载的关联
+type preloadTree map[string]preloadTree
+
+type preloadKey struct{}
+
+// 把Preload的路径解析为树，例如 "OrmCs", "OrmCs.Author" 解析为 {OrmCs: {Author: {}}}
+func newPreloadTree(paths []string) preloadTree {
+	tree := preloadTree{}
+	for _, path := range paths {
+		node := tree
+		for _, name := range strings.Split(path, ".") {
+			child, ok := node[name]
+			if !ok {
+				child = preloadTree{}
+				node[name] = child
+			}
+			node = child
+		}
+	}
+	return tree
+}
+
+func withPreload(c context.Context, tree preloadTree) context.Context {
+	return context.WithValue(ensureContext(c), preloadKey{}, tree)
+}
+
+// 去掉c中的Preload，关联、hook中的查询不再使用查询根类型的Preload
+func withoutPreload(c context.Context) context.Context {
+	if c == nil || c.Value(preloadKey{}) == nil {
+		return c
+	}
+	return context.WithValue(c, preloadKey{}, nil)
+}
+
+// t需要加载的关联，调用了Preload时只加载指定的关联，否则加载t的所有关联，但是不会继续加载关联的关联。
+// Preload的关联在执行sql之前检查，t或者下一层关联中不存在时返回RelationError
+func relationTree(c context.Context, t reflect.Type) (preloadTree, error) {
+	if c != nil {
+		if tree, ok := c.Value(preloadKey{}).(preloadTree); ok {
+			return tree, checkPreloadTree(t, tree)
+		}
+	}
+	_, _, orCols, err := getOrColumnsByType(t)
+	if err != nil {
+		return nil, err
+	}
+	tree := make(preloadTree, len(orCols))
+	for _, orCol := range orCols {
+		tree[orCol.fieldName] = nil
+	}
+	return tree, nil
+}
+
+func checkPreloadTree(t reflect.Type, tree preloadTree) error {
+	if len(tree) == 0 {
+		return nil
+	}
+	_, _, orCols, err := getOrColumnsByType(t)
+	if err != nil {
+		return err
+	}
+	for name, sub := range tree {
+		var orCol *orColumn
+		for _, col := range orCols {
+			if col.fieldName == name {
+				orCol = col
+			}
+		}
+		if orCol == nil {
+			return &RelationError{Field: name, Message: "unknown relation " + name + " on " + t.Name()}
+		}
+		if err := checkPreloadTree(orCol.orType, sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 关联使用的数据库字段，返回当前表和关联表中的字段。
+// has_one和has_many时ref为当前表的字段，默认为主键，fk为关联表的字段，默认和ref相同；
+// belongs_to时fk为当前表的字段，默认和ref相同，ref为关联表的字段，默认为关联表的主键
+func (orCol *orColumn) keyColumns(owner reflect.Type) ([]string, []string, error) {
+	var ownerCols, relCols []string
+	if orCol.or == "belongs_to" {
+		relCols = orCol.refs
+		if len(relCols) == 0 {
+			relCols = getModelMeta(orCol.orType).pkCols
+		}
+		ownerCols = orCol.fks
+		if len(ownerCols) == 0 {
+			ownerCols = relCols
+		}
+	} else {
+		ownerCols = orCol.refs
+		if len(ownerCols) == 0 {
+			ownerCols = getModelMeta(owner).pkCols
+		}
+		relCols = orCol.fks
+		if len(relCols) == 0 {
+			relCols = ownerCols
+		}
+	}
+	if len(ownerCols) == 0 || len(relCols) == 0 {
+		return nil, nil, fmt.Errorf("%s %w for %s %s", orCol.table, ErrNoPrimaryKey, orCol.or, orCol.fieldName)
+	}
+	if len(ownerCols) != len(relCols) {
+		return nil, nil, &RelationError{Field: orCol.fieldName, Message: orCol.fieldName + " should have the same number of fk and ref columns"}
+	}
+	return ownerCols, relCols, nil
+}
+
+// 按照fields的值对values分组，返回去重后的值以及值到values的映射，值为NULL的记录没有关联，会被跳过
+func groupByFields(values []reflect.Value, fields []string, table string) ([][]interface{}, map[interface{}][]reflect.Value, error) {
+	keys := make([][]interface{}, 0, len(values))
+	groups := map[interface{}][]reflect.Value{}
+	for _, v := range values {
+		key, ok := getFieldValues(v.Elem(), fields)
+		if !ok {
+			return nil, nil, &MissingFieldError{Table: table, Field: strings.Join(fields, ",")}
+		}
+		k := relationKey(key)
+		if k == nil {
+			continue
+		}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, key)
+		}
+		groups[k] = append(groups[k], v)
+	}
+	return keys, groups, nil
+}
+
+// 批量加载values的关联，values为t类型struct的指针，每一层的每个关联只需要一次查询(超过relationChunkSize时拆分)
+func loadRelations(c context.Context, tdx Tdx, t reflect.Type, values []reflect.Value, tree preloadTree) error {
+	if len(values) == 0 || len(tree) == 0 {
+		return nil
+	}
+	pkFields, _, orCols, err := getOrColumnsByType(t)
+	if err != nil {
+		return err
+	}
+	meta := getModelMeta(t)
+	for _, orCol := range orCols {
+		sub, ok := tree[orCol.fieldName]
+		if !ok {
+			continue
+		}
+		//加载到的关联记录，用于继续加载下一层以及调用AfterFind、保存快照
+		children := make([]reflect.Value, 0)
+		findHook := needAfterLoad(orCol.orType)
+		collect := func(orValue reflect.Value) {
+			if len(sub) > 0 || findHook {
+				children = append(children, orValue)
+			}
+		}
+		//把关联记录赋值给对应的字段，has_many和many_to_many时追加到slice中
+		assign := func(v reflect.Value, orValue reflect.Value) {
+			field := v.Elem().FieldByName(orCol.fieldName)
+			if orCol.or == "has_many" || orCol.or == "many_to_many" {
+				field.Set(reflect.Append(field, orValue))
+			} else {
+				field.Set(orValue)
+			}
+		}
+		if orCol.or == "many_to_many" {
+			keys, groups, err := groupByFields(values, pkFields, t.Name())
+			if err != nil {
+				return err
+			}
+			seen := map[uintptr]bool{}
+			err = selectManyToMany(c, tdx, t, orCol, keys, func(ownerKey interface{}, orValue reflect.Value) {
+				for _, v := range groups[ownerKey] {
+					assign(v, orValue)
+				}
+				if !seen[orValue.Pointer()] {
+					seen[orValue.Pointer()] = true
+					collect(orValue)
+				}
+			})
+			if err != nil {
+				return err
+			}
+		} else {
+			// 先把当前表中关联字段的值 -> array(elem)存下来，然后根据数据库请求结果将关联对象赋值给对应的elem
+			ownerCols, relCols, err := orCol.keyColumns(t)
+			if err != nil {
+				return err
+			}
+			relFields := getModelMeta(orCol.orType).fieldNames(relCols)
+			keys, groups, err := groupByFields(values, meta.fieldNames(ownerCols), t.Name())
+			if err != nil {
+				return err
+			}
+			err = selectRelation(c, tdx, orCol, relCols, keys, func(orValue reflect.Value) {
+				if keyValue, ok := getFieldValues(orValue.Elem(), relFields); ok {
+					for _, v := range groups[relationKey(keyValue)] {
+						assign(v, orValue)
+					}
+				}
+				collect(orValue)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err := loadRelations(c, tdx, orCol.orType, children, sub); err != nil {
+			return err
+		}
+		if err := afterLoad(c, tdx, orCol.orType, children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// many_to_many关联的中间表信息，join_fk默认为当前表的主键，join_ref默认为关联表的主键
+func (orCol *orColumn) joinColumns(owner reflect.Type) (string, string, error) {
+	ownerMeta := getModelMeta(owner)
+	refMeta := getModelMeta(orCol.orType)
+	if len(ownerMeta.pks) != 1 || len(refMeta.pks) != 1 {
+		return "", "", &RelationError{Field: orCol.fieldName, Message: orCol.fieldName + " many_to_many only supports single primary key on both sides"}
+	}
+	joinFk, joinRef := orCol.joinFk, orCol.joinRef
+	if joinFk == "" {
+		joinFk = ownerMeta.pkCols[0]
+	}
+	if joinRef == "" {
+		joinRef = refMeta.pkCols[0]
+	}
+	return joinFk, joinRef, nil
+}
+
+// 批量加载many_to_many关联，先从中间表查出关联关系，再按照主键批量查询关联表，每个关联的记录都会调用fn
+func selectManyToMany(c context.Context, tdx Tdx, owner reflect.Type, orCol *orColumn, keys [][]interface{}, fn func(ownerKey interface{}, orValue reflect.Value)) error {
+	joinFk, joinRef, err := orCol.joinColumns(owner)
+	if err != nil {
+		return err
+	}
+	ownerPk := getModelMeta(owner).pks[0]
+	refMeta := getModelMeta(orCol.orType)
+	refPk := refMeta.pks[0]
+
+	refKeys := make([][]interface{}, 0)
+	refOwners := map[interface{}][]interface{}{}
+	for start := 0; start < len(keys); start += relationChunkSize {
+		end := start + relationChunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		where, args := inSQL([]string{joinFk}, keys[start:end])
+		queryStr := lockSQL(c, fmt.Sprintf("SELECT %s,%s FROM %s WHERE %s", joinFk, joinRef, orCol.joinTable, where), true)
+		rows, err := queryWithoutLimit(c, tdx, queryStr, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			//按照两边主键的类型scan，保证和主键的值可以匹配上
+			fk := reflect.New(owner.Field(ownerPk.index).Type)
+			ref := reflect.New(orCol.orType.Field(refPk.index).Type)
+			if err := rows.Scan(fk.Interface(), ref.Interface()); err != nil {
+				rows.Close()
+				return err
+			}
+			refKey := relationKey([]interface{}{ref.Elem().Interface()})
+			if _, ok := refOwners[refKey]; !ok {
+				refKeys = append(refKeys, []interface{}{ref.Elem().Interface()})
+			}
+			refOwners[refKey] = append(refOwners[refKey], relationKey([]interface{}{fk.Elem().Interface()}))
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if len(refKeys) == 0 {
+		return nil
+	}
+	return selectRelation(c, tdx, orCol, refMeta.pkCols, refKeys, func(orValue reflect.Value) {
+		if keyValue, ok := getFieldValues(orValue.Elem(), refMeta.pkFields); ok {
+			for _, ownerKey := range refOwners[relationKey(keyValue)] {
+				fn(ownerKey, orValue)
+			}
+		}
+	})
+}
+
+// 找到s中field对应的many_to_many关联，返回中间表的字段和s的主键值
+func getManyToMany(s interface{}, field string) (*orColumn, string, string, interface{}, error) {
+	v := reflect.ValueOf(s)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, "", "", nil, errors.New("holder should be pointer")
+	}
+	t := v.Elem().Type()
+	m := getModelMeta(t)
+	if m.relErr != nil {
+		return nil, "", "", nil, m.relErr
+	}
+	for _, orCol := range m.relations {
+		if orCol.fieldName != field {
+			continue
+		}
+		if orCol.or != "many_to_many" {
+			return nil, "", "", nil, &RelationError{Field: field, Message: field + " is not a many_to_many relation"}
+		}
+		joinFk, joinRef, err := orCol.joinColumns(t)
+		if err != nil {
+			return nil, "", "", nil, err
+		}
+		return orCol, joinFk, joinRef, v.Elem().Field(m.pks[0].index).Interface(), nil
+	}
+	return nil, "", "", nil, &MissingFieldError{Table: getTableName(s), Field: field}
+}
+
+// 获取关联对象的主键值，targets为关联表对应struct的指针
+func getRefValues(orCol *orColumn, targets []interface{}) ([]interface{}, error) {
+	refPk := getModelMeta(orCol.orType).pks[0]
+	ret := make([]interface{}, len(targets))
+	for i, target := range targets {
+		tv := reflect.ValueOf(target)
+		if tv.Kind() != reflect.Ptr || tv.Elem().Type() != orCol.orType {
+			return nil, fmt.Errorf("%s should be added with *%s, but got %T", orCol.fieldName, orCol.orType.Name(), target)
+		}
+		ret[i] = tv.Elem().Field(refPk.index).Interface()
+	}
+	return ret, nil
+}
+
+// 在中间表中增加s和targets的关联
+func addAssociation(c context.Context, tdx Tdx, s interface{}, field string, targets ...interface{}) error {
+	if len(targets) == 0 {
+		return nil
+	}
+	orCol, joinFk, joinRef, pk, err := getManyToMany(s, field)
+	if err != nil {
+		return err
+	}
+	refs, err := getRefValues(orCol, targets)
+	if err != nil {
+		return err
+	}
+	vals := make([]string, len(refs))
+	args := make([]interface{}, 0, len(refs)*2)
+	for i, ref := range refs {
+		vals[i] = "(?,?)"
+		args = append(args, pk, ref)
+	}
+	_, err = exec(c, tdx, fmt.Sprintf("insert into %s (%s,%s) values %s", orCol.joinTable, joinFk, joinRef, strings.Join(vals, ",")), args...)
+	return err
+}
+
+// 从中间表中删除s和targets的关联，返回删除的行数
+func removeAssociation(c context.Context, tdx Tdx, s interface{}, field string, targets ...interface{}) (int64, error) {
+	if len(targets) == 0 {
+		return 0, nil
+	}
+	orCol, joinFk, joinRef, pk, err := getManyToMany(s, field)
+	if err != nil {
+		return 0, err
+	}
+	refs, err := getRefValues(orCol, targets)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([][]interface{}, len(refs))
+	for i, ref := range refs {
+		keys[i] = []interface{}{ref}
+	}
+	where, args := inSQL([]string{joinRef}, keys)
+	ret, err := exec(c, tdx, fmt.Sprintf("delete from %s where %s = ? and %s", orCol.joinTable, joinFk, where), append([]interface{}{pk}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	return ret.RowsAffected()
+}
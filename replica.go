@@ -0,0 +1,92 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ReplicaPolicy 从库的负载均衡策略，replicas不会为空
+type ReplicaPolicy interface {
+	Pick(c context.Context, replicas []*sql.DB) *sql.DB
+}
+
+// RoundRobinPolicy 依次轮询从库，默认的策略
+type RoundRobinPolicy struct {
+	n uint64
+}
+
+func (p *RoundRobinPolicy) Pick(c context.Context, replicas []*sql.DB) *sql.DB {
+	n := atomic.AddUint64(&p.n, 1)
+	return replicas[(n-1)%uint64(len(replicas))]
+}
+
+// RandomPolicy 随机选择一个从库
+type RandomPolicy struct{}
+
+func (p RandomPolicy) Pick(c context.Context, replicas []*sql.DB) *sql.DB {
+	return replicas[rand.Intn(len(replicas))]
+}
+
+type forceMasterKey struct{}
+
+// ForceMaster 返回一个要求读操作也走主库的context，用于写入后需要马上读到结果的场景，
+// 例如 o.WithContext(orm.ForceMaster(c)).SelectByPK(...)
+func ForceMaster(c context.Context) context.Context {
+	return context.WithValue(ensureContext(c), forceMasterKey{}, true)
+}
+
+func isForceMaster(c context.Context) bool {
+	if c == nil {
+		return false
+	}
+	force, _ := c.Value(forceMasterKey{}).(bool)
+	return force
+}
+
+// NewORMWithReplicas 创建一个读写分离的ORM，写操作和事务使用master，读操作按照ReplicaPolicy分配到replicas上
+func NewORMWithReplicas(master string, replicas ...string) *ORM {
+	ret, err := NewORMWithConfig(Config{DSN: master, ReplicaDSNs: replicas})
+	if err != nil {
+		logrus.WithError(err).Fatal("Can not connect to db")
+	}
+	return ret
+}
+
+// SetReplicaPolicy 设置从库的负载均衡策略，默认为RoundRobinPolicy
+func (o *ORM) SetReplicaPolicy(p ReplicaPolicy) {
+	o.policy = p
+}
+
+// Master 返回一个所有操作都使用主库的ORM
+func (o *ORM) Master() *ORM {
+	no := new(ORM)
+	*no = *o
+	no.master = true
+	return no
+}
+
+// 读操作使用的连接，context中有事务时使用事务，没有从库、调用了Master或者context中要求强制主库时使用主库
+func (o *ORM) reader() Tdx {
+	if tran := tranFromContext(o.ctx, o.db); tran != nil {
+		return tran.tx
+	}
+	if len(o.replicas) == 0 || o.master || isForceMaster(o.ctx) {
+		return o.db
+	}
+	if o.policy == nil {
+		return o.replicas[0]
+	}
+	return o.policy.Pick(ensureContext(o.ctx), o.replicas)
+}
+
+// 写操作使用的连接，context中有事务时使用事务
+func (o *ORM) writer() Tdx {
+	if tran := tranFromContext(o.ctx, o.db); tran != nil {
+		return tran.tx
+	}
+	return o.db
+}
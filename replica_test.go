@@ -0,0 +1,61 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+)
+
+func TestReplicaRouting(t *testing.T) {
+	o := NewORMWithReplicas("root@/orm_test?parseTime=true&loc=Local",
+		"root@/orm_test?parseTime=true&loc=Local", "root@/orm_test?parseTime=true&loc=Local")
+	defer o.Close()
+	assert.Equal(t, len(o.replicas), 2)
+
+	//默认轮询从库
+	assert.Equal(t, o.reader(), Tdx(o.replicas[0]))
+	assert.Equal(t, o.reader(), Tdx(o.replicas[1]))
+	assert.Equal(t, o.reader(), Tdx(o.replicas[0]))
+
+	//强制主库
+	assert.Equal(t, o.Master().reader(), Tdx(o.db))
+	assert.Equal(t, o.Master().withContext(context.Background()).reader(), Tdx(o.db))
+	assert.Equal(t, o.withContext(ForceMaster(context.Background())).reader(), Tdx(o.db))
+
+	//查询构造器的写操作始终使用主库
+	q := o.From(&TestOrmA123{})
+	assert.Equal(t, q.tdx, Tdx(o.db))
+
+	o.SetReplicaPolicy(&lastReplicaPolicy{})
+	assert.Equal(t, o.reader(), Tdx(o.replicas[1]))
+}
+
+type lastReplicaPolicy struct{}
+
+func (p *lastReplicaPolicy) Pick(c context.Context, replicas []*sql.DB) *sql.DB {
+	return replicas[len(replicas)-1]
+}
+
+func TestReplicaReadWrite(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		o := NewORMWithReplicas("root@/orm_test?parseTime=true&loc=Local", "root@/orm_test?parseTime=true&loc=Local")
+		defer o.Close()
+		obj := &TestOrmA123{OtherId: 1, Description: "replica"}
+		if err := o.Insert(obj); err != nil {
+			t.Fatal(err)
+		}
+		var loaded TestOrmA123
+		if err := o.WithContext(ForceMaster(context.Background())).SelectByPK(&loaded, obj.TestID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.Description, "replica")
+		var list []*TestOrmA123
+		if err := o.Select(&list, "select * from test_orm_a123"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(list), 1)
+		assert.Equal(t, o.replicas[0].Stats().OpenConnections > 0, true)
+	})
+}
@@ -0,0 +1,93 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+type unscopedKey struct{}
+
+func withUnscoped(c context.Context) context.Context {
+	return context.WithValue(ensureContext(c), unscopedKey{}, true)
+}
+
+func isUnscoped(c context.Context) bool {
+	if c == nil {
+		return false
+	}
+	unscoped, _ := c.Value(unscopedKey{}).(bool)
+	return unscoped
+}
+
+// time.Time类型软删除字段的Scan目标，NULL表示没有删除，设置为零值
+type nullZeroTime struct {
+	t *time.Time
+}
+
+func (n nullZeroTime) Scan(src interface{}) error {
+	var nt sql.NullTime
+	if err := nt.Scan(src); err != nil {
+		return err
+	}
+	*n.t = nt.Time
+	return nil
+}
+
+// t的软删除字段，没有softdelete标签或者context要求Unscoped时返回nil，t不能是指针
+func softDeleteField(c context.Context, t reflect.Type) *modelField {
+	if t.Kind() != reflect.Struct || isUnscoped(c) {
+		return nil
+	}
+	return getModelMeta(t).softDelete
+}
+
+// 通过主键恢复软删除的记录
+func restore(c context.Context, tdx Tdx, s interface{}) error {
+	t := reflect.TypeOf(s)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%s should be pointer of struct", t)
+	}
+	f := getModelMeta(t.Elem()).softDelete
+	tabName := getTableName(s)
+	if f == nil {
+		return fmt.Errorf("%s does not have soft delete field", tabName)
+	}
+	_, pk := columnsByStructFields(s, nil)
+	if len(pk.names) == 0 {
+		return fmt.Errorf("%s %w", tabName, ErrNoPrimaryKey)
+	}
+	//记录不存在或者没有被删除时返回RowAffectError
+	q := fmt.Sprintf("update %s set %s = NULL where %s and %s IS NOT NULL", tabName, f.column, pkWhereSQL(pk.names), f.column)
+	if err := execWithRowAffectCheck(c, tdx, 1, q, pk.args()...); err != nil {
+		return err
+	}
+	return setTimeValue(reflect.ValueOf(s).Elem().Field(f.index), nil)
+}
+
+// Unscoped 返回一个忽略软删除的ORM，查询时包含已经软删除的记录，删除时直接删除记录
+func (o *ORM) Unscoped() *ORM {
+	no := new(ORM)
+	*no = *o
+	no.unscoped = true
+	return no
+}
+
+// Restore 恢复通过DeleteByPK软删除的记录，s需要有softdelete标签的字段，记录不存在或者没有被删除时返回RowAffectError
+func (o *ORM) Restore(s interface{}) error {
+	return restore(o.context(), o.writer(), s)
+}
+
+// Unscoped 返回一个忽略软删除的ORMTran，用法和ORM.Unscoped一样
+func (o *ORMTran) Unscoped() *ORMTran {
+	no := new(ORMTran)
+	*no = *o
+	no.ctx = withUnscoped(o.ctx)
+	return no
+}
+
+func (o *ORMTran) Restore(s interface{}) error {
+	return restore(o.ctx, o.tx, s)
+}
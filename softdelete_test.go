@@ -0,0 +1,201 @@
+package orm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+)
+
+type TestOrmComment struct {
+	ID        int64 `db:"id,pk,ai"`
+	PostID    int64 `db:"post_id"`
+	Content   string
+	DeletedAt *time.Time `db:"deleted_at" softdelete:"true"`
+}
+
+type testSoftDeletePost struct {
+	ID       int64 `db:"id,pk,ai"`
+	AuthorID int64 `db:"author_id"`
+	Title    string
+	Comments []*TestOrmComment `or:"has_many" table:"test_orm_comment" fk:"post_id" ref:"id"`
+}
+
+func (p *testSoftDeletePost) TableName() string {
+	return "test_orm_post"
+}
+
+func TestSoftDelete(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		post := &testSoftDeletePost{AuthorID: 1, Title: "post"}
+		if err := orm.Insert(post); err != nil {
+			t.Fatal(err)
+		}
+		comments := make([]*TestOrmComment, 3)
+		for i := range comments {
+			comments[i] = &TestOrmComment{PostID: post.ID, Content: "comment"}
+			if err := orm.Insert(comments[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := orm.DeleteByPK(comments[0]); err != nil {
+			t.Fatal(err)
+		}
+		if comments[0].DeletedAt == nil {
+			t.Fatal("DeletedAt should be set")
+		}
+		//已经删除的记录不会被再次删除
+		if err := orm.DeleteByPKWithRowAffectCheck(comments[0]); !IsRowAffectError(err) {
+			t.Fatal("should not delete twice", err)
+		}
+		cnt, err := orm.SelectInt("select count(*) from test_orm_comment")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cnt, int64(3))
+
+		var loaded TestOrmComment
+		if err := orm.SelectByPK(&loaded, comments[0].ID); err != ErrRecordNotFound {
+			t.Fatal("soft deleted record should not be found", err)
+		}
+		if err := orm.Unscoped().SelectByPK(&loaded, comments[0].ID); err != nil {
+			t.Fatal(err)
+		}
+		if loaded.DeletedAt == nil {
+			t.Fatal("DeletedAt should be loaded")
+		}
+
+		var loadedPost testSoftDeletePost
+		if err := orm.SelectByPK(&loadedPost, post.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(loadedPost.Comments), 2)
+		loadedPost = testSoftDeletePost{}
+		if err := orm.Unscoped().SelectByPK(&loadedPost, post.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(loadedPost.Comments), 3)
+
+		list := make([]*TestOrmComment, 0)
+		if err := orm.From(&TestOrmComment{}).Where("post_id = ?", post.ID).Find(&list); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, len(list), 2)
+		n, err := orm.From(&TestOrmComment{}).Where("id = ?", comments[1].ID).Delete()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, n, int64(1))
+		n, err = orm.DeleteWhere(&TestOrmComment{}, "post_id = ?", post.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, n, int64(1))
+		n, err = orm.From(&TestOrmComment{}).Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, n, int64(0))
+
+		if err := orm.Restore(comments[0]); err != nil {
+			t.Fatal(err)
+		}
+		if comments[0].DeletedAt != nil {
+			t.Fatal("DeletedAt should be cleared")
+		}
+		if err := orm.SelectByPK(&loaded, comments[0].ID); err != nil {
+			t.Fatal(err)
+		}
+
+		//没有被删除或者不存在的记录不能恢复
+		deletedAt := time.Now()
+		loaded.DeletedAt = &deletedAt
+		if err := orm.Restore(&loaded); !IsRowAffectError(err) {
+			t.Fatal("should not restore a live record", err)
+		}
+		if loaded.DeletedAt == nil {
+			t.Fatal("DeletedAt should not be cleared when restore fails")
+		}
+		if err := orm.Restore(&TestOrmComment{ID: -1}); !IsRowAffectError(err) {
+			t.Fatal("should not restore a missing record", err)
+		}
+
+		//Unscoped时直接删除
+		err = orm.DoTransaction(func(ot *ORMTran) error {
+			return ot.Unscoped().DeleteByPK(comments[0])
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cnt, err = orm.SelectInt("select count(*) from test_orm_comment")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cnt, int64(2))
+	})
+}
+
+type testSoftDeleteTimeComment struct {
+	ID        int64 `db:"id,pk,ai"`
+	PostID    int64 `db:"post_id"`
+	Content   string
+	DeletedAt time.Time `db:"deleted_at" softdelete:"true"`
+}
+
+func (c *testSoftDeleteTimeComment) TableName() string {
+	return "test_orm_comment"
+}
+
+func TestSoftDeleteTimeField(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		comment := &testSoftDeleteTimeComment{PostID: 1, Content: "comment"}
+		if err := orm.Insert(comment); err != nil {
+			t.Fatal(err)
+		}
+		//零值写入NULL
+		cnt, err := orm.SelectInt("select count(*) from test_orm_comment where deleted_at IS NULL")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cnt, int64(1))
+		var loaded testSoftDeleteTimeComment
+		if err := orm.SelectByPK(&loaded, comment.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.DeletedAt.IsZero(), true)
+
+		if err := orm.DeleteByPK(comment); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, comment.DeletedAt.IsZero(), false)
+		if err := orm.SelectByPK(&loaded, comment.ID); err != ErrRecordNotFound {
+			t.Fatal("soft deleted record should not be found", err)
+		}
+		if err := orm.Unscoped().SelectByPK(&loaded, comment.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.DeletedAt.IsZero(), false)
+
+		if err := orm.Restore(comment); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, comment.DeletedAt.IsZero(), true)
+		loaded = testSoftDeleteTimeComment{}
+		if err := orm.SelectByPK(&loaded, comment.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.DeletedAt.IsZero(), true)
+
+		//更新时零值仍然写入NULL
+		loaded.Content = "updated"
+		if err := orm.UpdateByPK(&loaded); err != nil {
+			t.Fatal(err)
+		}
+		cnt, err = orm.SelectInt("select count(*) from test_orm_comment where deleted_at IS NULL")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cnt, int64(1))
+	})
+}
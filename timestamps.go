@@ -0,0 +1,153 @@
+package orm
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// 保存func() time.Time，没有设置时使用time.Now
+var clock atomic.Value
+
+// SetClock 设置autoCreateTime、autoUpdateTime和软删除使用的时钟，一般用于测试，f为nil时恢复为time.Now
+func SetClock(f func() time.Time) {
+	if f == nil {
+		f = time.Now
+	}
+	clock.Store(f)
+}
+
+func currentTime() time.Time {
+	if f, ok := clock.Load().(func() time.Time); ok {
+		return f()
+	}
+	return time.Now()
+}
+
+// 时间字段是否为空，支持time.Time、*time.Time和sql.NullTime
+func isZeroTime(fv reflect.Value) bool {
+	switch t := fv.Interface().(type) {
+	case time.Time:
+		return t.IsZero()
+	case *time.Time:
+		return t == nil || t.IsZero()
+	case sql.NullTime:
+		return !t.Valid
+	}
+	return fv.IsZero()
+}
+
+// 给时间字段赋值，tm为nil时设置为空，字段需要是time.Time、*time.Time或者sql.NullTime这样的实现了sql.Scanner的类型
+func setTimeValue(fv reflect.Value, tm *time.Time) error {
+	switch fv.Type() {
+	case timeType:
+		if tm == nil {
+			fv.Set(reflect.Zero(timeType))
+		} else {
+			fv.Set(reflect.ValueOf(*tm))
+		}
+		return nil
+	case reflect.PtrTo(timeType):
+		if tm == nil {
+			fv.Set(reflect.Zero(fv.Type()))
+		} else {
+			t := *tm
+			fv.Set(reflect.ValueOf(&t))
+		}
+		return nil
+	}
+	if scanner, ok := fv.Addr().Interface().(sql.Scanner); ok {
+		if tm == nil {
+			return scanner.Scan(nil)
+		}
+		return scanner.Scan(*tm)
+	}
+	return fmt.Errorf("unsupported time field type %s", fv.Type())
+}
+
+// 一次insert或者update中自动设置的时间字段，sql中使用tm，执行成功之后才写回struct
+type autoTimes struct {
+	tm      time.Time
+	creates []*modelField //需要设置的autoCreateTime字段
+	updates []*modelField //需要设置的autoUpdateTime字段
+}
+
+// insert时为空的autoCreateTime和autoUpdateTime字段，已经有值的字段不会被覆盖
+func insertTimes(v reflect.Value, tm time.Time) *autoTimes {
+	m := getModelMeta(v.Type())
+	ret := &autoTimes{tm: tm}
+	for _, f := range m.createTimes {
+		if isZeroTime(v.Field(f.index)) {
+			ret.creates = append(ret.creates, f)
+		}
+	}
+	for _, f := range m.updateTimes {
+		if isZeroTime(v.Field(f.index)) {
+			ret.updates = append(ret.updates, f)
+		}
+	}
+	return ret
+}
+
+// update时所有的autoUpdateTime字段
+func updateTimes(v reflect.Value, tm time.Time) *autoTimes {
+	return &autoTimes{tm: tm, updates: getModelMeta(v.Type()).updateTimes}
+}
+
+// 字段f在sql中的参数，自动设置的字段使用tm
+func (a *autoTimes) arg(v reflect.Value, f *modelField) interface{} {
+	if containField(a.creates, f) || containField(a.updates, f) {
+		return a.tm
+	}
+	return fieldArg(v, f)
+}
+
+// 替换columnsByStruct返回的参数中自动设置的字段，args和meta中的inserts一一对应
+func (a *autoTimes) replaceArgs(v reflect.Value, args []interface{}) {
+	for i, f := range getModelMeta(v.Type()).inserts {
+		args[i] = a.arg(v, f)
+	}
+}
+
+// sql执行成功后把时间写回struct，created为false时只写回autoUpdateTime字段
+func (a *autoTimes) apply(v reflect.Value, created bool) error {
+	fields := a.updates
+	if created {
+		fields = append(append([]*modelField{}, a.creates...), a.updates...)
+	}
+	for _, f := range fields {
+		if err := setTimeValue(v.Field(f.index), &a.tm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isCreateTimeColumn(m *modelMeta, col string) bool {
+	for _, f := range m.createTimes {
+		if f.column == col {
+			return true
+		}
+	}
+	return false
+}
+
+func containField(fields []*modelField, f *modelField) bool {
+	for _, v := range fields {
+		if v == f {
+			return true
+		}
+	}
+	return false
+}
+
+func containString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package orm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+)
+
+type TestOrmEvent struct {
+	ID        int64 `db:"id,pk,ai"`
+	Name      string
+	CreatedAt time.Time `autoCreateTime:"true"`
+	UpdatedAt time.Time `autoUpdateTime:"true"`
+}
+
+func TestAutoTimestamps(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+		SetClock(func() time.Time { return now })
+		defer SetClock(nil)
+
+		event := &TestOrmEvent{Name: "a"}
+		if err := orm.Insert(event); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, event.CreatedAt, now)
+		assert.Equal(t, event.UpdatedAt, now)
+
+		//查询时仍然会读取时间字段
+		var loaded TestOrmEvent
+		if err := orm.SelectByPK(&loaded, event.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.CreatedAt.Equal(now), true)
+		assert.Equal(t, loaded.UpdatedAt.Equal(now), true)
+
+		//update只更新updated_at
+		created := now
+		now = now.Add(time.Hour)
+		loaded.CreatedAt = time.Time{}
+		if err := orm.UpdateByPK(&loaded); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.UpdatedAt, now)
+		if err := orm.SelectByPK(&loaded, event.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.CreatedAt.Equal(created), true)
+		assert.Equal(t, loaded.UpdatedAt.Equal(now), true)
+
+		now = now.Add(time.Hour)
+		loaded.Name = "b"
+		if err := orm.UpdateFieldsByPK(&loaded, []string{"Name"}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.UpdatedAt, now)
+
+		//已经设置的创建时间不会被覆盖
+		events := []interface{}{
+			&TestOrmEvent{Name: "c"},
+			&TestOrmEvent{Name: "d", CreatedAt: created},
+		}
+		if err := orm.InsertBatch(events); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, events[0].(*TestOrmEvent).CreatedAt, now)
+		assert.Equal(t, events[1].(*TestOrmEvent).CreatedAt, created)
+		assert.Equal(t, events[1].(*TestOrmEvent).UpdatedAt, now)
+
+		//重复时更新updated_at，created_at保持不变
+		now = now.Add(time.Hour)
+		dup := &TestOrmEvent{Name: "c"}
+		if err := orm.InsertOrUpdate(dup, []string{"Name"}); err != nil {
+			t.Fatal(err)
+		}
+		var c TestOrmEvent
+		if err := orm.SelectOne(&c, "select * from test_orm_event where name = ?", "c"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, c.CreatedAt.Equal(now.Add(-time.Hour)), true)
+		assert.Equal(t, c.UpdatedAt.Equal(now), true)
+		//更新时没有写入的created_at不会修改struct
+		assert.Equal(t, dup.CreatedAt.IsZero(), true)
+		assert.Equal(t, dup.UpdatedAt, now)
+
+		//执行失败时不修改struct
+		updatedAt := c.UpdatedAt
+		now = now.Add(time.Hour)
+		c.Name = "d"
+		if err := orm.UpdateByPK(&c); !IsDuplicateKeyError(err) {
+			t.Fatal("should fail with duplicate name", err)
+		}
+		assert.Equal(t, c.UpdatedAt, updatedAt)
+		if err := orm.UpdateFieldsByPK(&c, []string{"Name"}); !IsDuplicateKeyError(err) {
+			t.Fatal("should fail with duplicate name", err)
+		}
+		assert.Equal(t, c.UpdatedAt, updatedAt)
+
+		//fields中有created_at时重复也不会覆盖创建时间
+		now = now.Add(time.Hour)
+		dup = &TestOrmEvent{Name: "c"}
+		if err := orm.InsertOrUpdate(dup, []string{"name", "created_at", "updated_at"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := orm.SelectByPK(&c, c.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, c.CreatedAt.Equal(created.Add(2*time.Hour)), true)
+		assert.Equal(t, c.UpdatedAt.Equal(now), true)
+	})
+}
+
+type testOrmLegacyEvent struct {
+	ID        int64 `db:"id,pk,ai"`
+	Name      string
+	CreatedAt time.Time `ignore:"true" autoCreateTime:"true"`
+	UpdatedAt time.Time `ignore:"true" autoUpdateTime:"true"`
+}
+
+func (e *testOrmLegacyEvent) TableName() string {
+	return "test_orm_event"
+}
+
+func TestAutoTimestampsWithIgnoreTag(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+		SetClock(func() time.Time { return now })
+		defer SetClock(nil)
+
+		//老的生成代码中时间字段带有ignore标签，有auto标签时仍然自动写入
+		event := &testOrmLegacyEvent{Name: "a"}
+		if err := orm.Insert(event); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, event.CreatedAt, now)
+		assert.Equal(t, event.UpdatedAt, now)
+
+		created := now
+		now = now.Add(time.Hour)
+		event.Name = "b"
+		if err := orm.UpdateByPK(event); err != nil {
+			t.Fatal(err)
+		}
+		var loaded testOrmLegacyEvent
+		if err := orm.SelectByPK(&loaded, event.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.Name, "b")
+		assert.Equal(t, loaded.CreatedAt.Equal(created), true)
+		assert.Equal(t, loaded.UpdatedAt.Equal(now), true)
+	})
+}
@@ -0,0 +1,214 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// 同一个事务的ORMTran之间共享的状态，Preload等方法复制ORMTran时仍然指向同一个tranState
+type tranState struct {
+	savepoints int  //已经创建的savepoint数量，用于生成不重复的savepoint名字
+	done       bool //已经提交或者回滚
+	onCommit   []func()
+	onRollback []func()
+}
+
+// 事务提交或者回滚成功后执行对应的回调，每个回调只会执行一次
+func (s *tranState) runHooks(committed bool) {
+	if s == nil {
+		return
+	}
+	hooks := s.onRollback
+	if committed {
+		hooks = s.onCommit
+	}
+	s.onCommit, s.onRollback = nil, nil
+	for _, f := range hooks {
+		f()
+	}
+}
+
+// OnCommit 注册事务提交成功后执行的回调，例如发送消息、清理缓存，事务回滚时不会执行。
+// 在嵌套事务中注册的回调，嵌套事务回滚到savepoint时会被丢弃
+func (o *ORMTran) OnCommit(f func()) {
+	o.state.onCommit = append(o.state.onCommit, f)
+}
+
+// OnRollback 注册事务回滚成功后执行的回调，在嵌套事务中注册的回调会在回滚到savepoint后执行
+func (o *ORMTran) OnRollback(f func()) {
+	o.state.onRollback = append(o.state.onRollback, f)
+}
+
+// DoTransaction 在当前事务中通过SAVEPOINT执行嵌套事务，f返回error或者panic时只回滚到savepoint，不影响外层事务
+func (o *ORMTran) DoTransaction(f func(*ORMTran) error) (err error) {
+	if o.state == nil {
+		o.state = &tranState{}
+	}
+	o.state.savepoints++
+	name := fmt.Sprintf("orm_sp_%d", o.state.savepoints)
+	if _, err = exec(o.ctx, o.tx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+	commits, rollbacks := len(o.state.onCommit), len(o.state.onRollback)
+	defer func() {
+		perr := recover()
+		if err != nil || perr != nil {
+			if _, rerr := exec(o.ctx, o.tx, "ROLLBACK TO SAVEPOINT "+name); rerr == nil {
+				//嵌套事务中注册的回调只属于被回滚的部分
+				hooks := append([]func(){}, o.state.onRollback[rollbacks:]...)
+				o.state.onCommit = o.state.onCommit[:commits]
+				o.state.onRollback = o.state.onRollback[:rollbacks]
+				for _, f := range hooks {
+					f()
+				}
+			}
+			if perr != nil {
+				panic(perr)
+			}
+			return
+		}
+		_, err = exec(o.ctx, o.tx, "RELEASE SAVEPOINT "+name)
+	}()
+	err = f(o)
+	return err
+}
+
+// RetryOptions DoTransactionWithRetry的重试配置
+type RetryOptions struct {
+	MaxAttempts int                  //最多执行的次数，包括第一次，默认3次
+	Backoff     time.Duration        //第n次重试前等待Backoff*2^(n-1)，默认50ms
+	MaxBackoff  time.Duration        //等待时间的上限，默认1s
+	Jitter      time.Duration        //在等待时间上增加[0, Jitter)的随机时间，避免冲突的事务同时重试
+	Retryable   func(err error) bool //判断error是否可以重试，默认为死锁和等待行锁超时
+}
+
+func (opts *RetryOptions) setDefaults() {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 50 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Second
+	}
+	if opts.Retryable == nil {
+		opts.Retryable = IsRetryableError
+	}
+}
+
+func (opts *RetryOptions) wait(attempt int) time.Duration {
+	d := opts.Backoff
+	for i := 1; i < attempt && d < opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > opts.MaxBackoff {
+		d = opts.MaxBackoff
+	}
+	if opts.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(opts.Jitter)))
+	}
+	return d
+}
+
+// IsRetryableError 事务因为死锁或者等待行锁超时失败，重新执行整个事务可能成功
+func IsRetryableError(err error) bool {
+	return IsDeadlockError(err) || IsLockWaitTimeoutError(err)
+}
+
+// DoTransactionWithRetry 和DoTransaction一样，但是f返回可以重试的error时会回滚并重新执行整个事务，
+// 每次失败都会通过SqlLogger记录执行的次数和error，f可能被执行多次，不能有事务以外的副作用。
+// context中已经有事务时通过savepoint在该事务中执行并且不会重试，死锁时整个外层事务都已经被回滚
+func (o *ORM) DoTransactionWithRetry(opts RetryOptions, f func(*ORMTran) error) error {
+	if tran := tranFromContext(o.ctx, o.db); tran != nil {
+		return tran.DoTransaction(f)
+	}
+	opts.setDefaults()
+	c := ensureContext(o.context())
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := o.DoTransaction(f)
+		if err == nil {
+			return nil
+		}
+		//每次失败都记录，不再重试时记录为TRANSACTION FAILED
+		retry := attempt < opts.MaxAttempts && opts.Retryable(err)
+		sqlStr := "RETRY TRANSACTION"
+		if !retry {
+			sqlStr = "TRANSACTION FAILED"
+		}
+		getLogger(c).Log(c, &SqlLog{
+			Sql:      sqlStr,
+			Duration: time.Since(start),
+			Attempt:  attempt,
+			Error:    err.Error(),
+		})
+		if !retry {
+			return err
+		}
+		select {
+		case <-c.Done():
+			return err
+		case <-time.After(opts.wait(attempt)):
+		}
+	}
+}
+
+type tranKey struct{}
+
+// Propagation 通过context传递事务时的传播方式
+type Propagation int
+
+const (
+	PropagationRequired    Propagation = iota //context中有事务时加入该事务，否则开始新的事务
+	PropagationRequiresNew                    //总是开始新的事务，和context中的事务互不影响
+	PropagationNever                          //不使用事务执行，context中有事务时返回ErrTransactionExists
+)
+
+// 获取context中属于db并且还没有结束的事务
+func tranFromContext(c context.Context, db *sql.DB) *ORMTran {
+	if c == nil {
+		return nil
+	}
+	tran, ok := c.Value(tranKey{}).(*ORMTran)
+	if !ok || tran.db != db || tran.state.done {
+		return nil
+	}
+	return tran
+}
+
+// Context 事务使用的context，通过ORM.WithContext使用这个context时会自动加入事务
+func (o *ORMTran) Context() context.Context {
+	return withoutPreload(o.ctx)
+}
+
+// DoTransactionWithPropagation 按照传播方式执行f，f中通过o.WithContext(c)执行的sql会使用c中的事务，例如
+//
+//	o.WithContext(c).DoTransactionWithPropagation(orm.PropagationRequired, func(c context.Context) error {
+//		return o.WithContext(c).Insert(...)
+//	})
+func (o *ORM) DoTransactionWithPropagation(p Propagation, f func(c context.Context) error) error {
+	tran := tranFromContext(o.ctx, o.db)
+	switch p {
+	case PropagationRequired:
+		if tran != nil {
+			return f(o.ctx)
+		}
+	case PropagationNever:
+		if tran != nil {
+			return ErrTransactionExists
+		}
+		return f(o.ctx)
+	}
+	return o.doNewTransaction(nil, func(ot *ORMTran) error {
+		return f(ot.Context())
+	})
+}
+
+// DoTransactionWithPropagation 和ORM.DoTransactionWithPropagation一样，当前事务就是context中的事务
+func (o *ORMTran) DoTransactionWithPropagation(p Propagation, f func(c context.Context) error) error {
+	return NewORMFromDB(o.db).withContext(o.Context()).DoTransactionWithPropagation(p, f)
+}
@@ -0,0 +1,367 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/magiconair/properties/assert"
+)
+
+func TestDoTransactionWithRetry(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		logger := &collectSqlLogger{}
+		o, err := NewORMWithConfig(Config{DSN: "root@/orm_test?parseTime=true&loc=Local", Logger: logger})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer o.Close()
+
+		attempts := 0
+		err = o.DoTransactionWithRetry(RetryOptions{Backoff: time.Millisecond}, func(ot *ORMTran) error {
+			attempts++
+			if err := ot.Insert(&TestOrmD222{Name: "retry"}); err != nil {
+				return err
+			}
+			if attempts < 3 {
+				return &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, attempts, 3)
+		cnt, err := o.SelectInt("select count(*) from test_orm_d222")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cnt, int64(1))
+		retries := 0
+		for _, s := range logger.sqls {
+			if s == "RETRY TRANSACTION" {
+				retries++
+			}
+		}
+		assert.Equal(t, retries, 2)
+
+		//超过最大次数后返回最后一次的error
+		attempts = 0
+		err = o.DoTransactionWithRetry(RetryOptions{MaxAttempts: 2, Backoff: time.Millisecond}, func(ot *ORMTran) error {
+			attempts++
+			return &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}
+		})
+		assert.Equal(t, IsLockWaitTimeoutError(err), true)
+		assert.Equal(t, attempts, 2)
+		assert.Equal(t, logger.sqls[len(logger.sqls)-2:], []string{"RETRY TRANSACTION", "TRANSACTION FAILED"})
+
+		//不可重试的error直接返回
+		attempts = 0
+		err = o.DoTransactionWithRetry(RetryOptions{}, func(ot *ORMTran) error {
+			attempts++
+			return errors.New("fatal")
+		})
+		assert.Equal(t, err.Error(), "fatal")
+		assert.Equal(t, attempts, 1)
+		assert.Equal(t, logger.sqls[len(logger.sqls)-1], "TRANSACTION FAILED")
+
+		//自定义可重试的error
+		attempts = 0
+		err = o.DoTransactionWithRetry(RetryOptions{Backoff: time.Millisecond, Retryable: func(err error) bool { return err.Error() == "again" }}, func(ot *ORMTran) error {
+			attempts++
+			if attempts == 1 {
+				return errors.New("again")
+			}
+			return nil
+		})
+		assert.Equal(t, err, nil)
+		assert.Equal(t, attempts, 2)
+	})
+}
+
+func TestRetryOptionsWait(t *testing.T) {
+	opts := RetryOptions{Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+	opts.setDefaults()
+	assert.Equal(t, opts.MaxAttempts, 3)
+	assert.Equal(t, opts.wait(1), 10*time.Millisecond)
+	assert.Equal(t, opts.wait(2), 20*time.Millisecond)
+	assert.Equal(t, opts.wait(5), 30*time.Millisecond)
+
+	opts.Jitter = 5 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		d := opts.wait(1)
+		if d < 10*time.Millisecond || d >= 15*time.Millisecond {
+			t.Fatal("bad jitter", d)
+		}
+	}
+}
+
+func TestDoTransactionWithOptions(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		opts := &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+		err := orm.DoTransactionWithOptions(opts, func(ot *ORMTran) error {
+			assert.Equal(t, ot.Options(), *opts)
+			if _, err := ot.SelectInt("select count(*) from test_orm_d222"); err != nil {
+				return err
+			}
+			return ot.Insert(&TestOrmD222{Name: "read only"})
+		})
+		if err == nil {
+			t.Fatal("should not insert in read only transaction")
+		}
+
+		ot, err := orm.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, ot.Options().Isolation, sql.LevelSerializable)
+		if err := ot.Insert(&TestOrmD222{Name: "serializable"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ot.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		ot, err = orm.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ot.Rollback()
+		assert.Equal(t, ot.Options(), sql.TxOptions{})
+		cnt, err := ot.SelectInt("select count(*) from test_orm_d222")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cnt, int64(1))
+	})
+}
+
+func TestTransactionHooks(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		var events []string
+		err := orm.DoTransaction(func(ot *ORMTran) error {
+			ot.OnCommit(func() { events = append(events, "commit") })
+			ot.OnRollback(func() { events = append(events, "rollback") })
+			ot.DoTransaction(func(inner *ORMTran) error {
+				inner.OnCommit(func() { events = append(events, "inner commit") })
+				inner.OnRollback(func() { events = append(events, "inner rollback") })
+				return errors.New("rollback inner")
+			})
+			ot.Preload().DoTransaction(func(inner *ORMTran) error {
+				inner.OnCommit(func() { events = append(events, "inner commit 2") })
+				return nil
+			})
+			assert.Equal(t, events, []string{"inner rollback"})
+			return ot.Insert(&TestOrmD222{Name: "hooks"})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, events, []string{"inner rollback", "commit", "inner commit 2"})
+
+		events = nil
+		err = orm.DoTransaction(func(ot *ORMTran) error {
+			ot.OnCommit(func() { events = append(events, "commit") })
+			ot.OnRollback(func() { events = append(events, "rollback") })
+			return errors.New("rollback")
+		})
+		assert.Equal(t, err.Error(), "rollback")
+		assert.Equal(t, events, []string{"rollback"})
+
+		events = nil
+		_, err = orm.DoTransactionMore(func(ot *ORMTran) (interface{}, error) {
+			ot.OnCommit(func() { events = append(events, "commit") })
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, events, []string{"commit"})
+
+		//f返回error时回滚，不会执行OnCommit
+		events = nil
+		_, err = orm.DoTransactionMore(func(ot *ORMTran) (interface{}, error) {
+			ot.OnCommit(func() { events = append(events, "commit") })
+			ot.OnRollback(func() { events = append(events, "rollback") })
+			if err := ot.Insert(&TestOrmD222{Name: "more"}); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("rollback more")
+		})
+		assert.Equal(t, err.Error(), "rollback more")
+		assert.Equal(t, events, []string{"rollback"})
+		cnt, err := orm.SelectInt("select count(*) from test_orm_d222 where name = ?", "more")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cnt, int64(0))
+
+		//panic时回滚之后继续panic
+		events = nil
+		func() {
+			defer func() {
+				assert.Equal(t, recover(), "panic more")
+			}()
+			orm.DoTransactionMore(func(ot *ORMTran) (interface{}, error) {
+				ot.OnRollback(func() { events = append(events, "rollback") })
+				panic("panic more")
+			})
+		}()
+		assert.Equal(t, events, []string{"rollback"})
+	})
+}
+
+func TestTransactionPropagation(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		countByName := func(name string) int64 {
+			cnt, err := orm.SelectInt("select count(*) from test_orm_d222 where name = ?", name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return cnt
+		}
+		//只依赖context的业务代码
+		insertD := func(c context.Context, p Propagation, name string) error {
+			return orm.WithContext(c).DoTransactionWithPropagation(p, func(c context.Context) error {
+				return orm.WithContext(c).Insert(&TestOrmD222{Name: name})
+			})
+		}
+
+		err := orm.DoTransaction(func(ot *ORMTran) error {
+			c := ot.Context()
+			if err := insertD(c, PropagationRequired, "required"); err != nil {
+				return err
+			}
+			//加入事务后可以读到事务中的数据
+			cnt, err := orm.WithContext(c).SelectInt("select count(*) from test_orm_d222 where name = ?", "required")
+			if err != nil {
+				return err
+			}
+			assert.Equal(t, cnt, int64(1))
+			assert.Equal(t, countByName("required"), int64(0))
+
+			if err := insertD(c, PropagationRequiresNew, "requires new"); err != nil {
+				return err
+			}
+			assert.Equal(t, countByName("requires new"), int64(1))
+
+			assert.Equal(t, insertD(c, PropagationNever, "never"), ErrTransactionExists)
+			assert.Equal(t, ot.DoTransactionWithPropagation(PropagationNever, func(c context.Context) error { return nil }), ErrTransactionExists)
+
+			//WithContext之后仍然在同一个事务中
+			wc := ot.Unscoped().WithContext(context.Background())
+			assert.Equal(t, wc.DoTransactionWithPropagation(PropagationNever, func(c context.Context) error { return nil }), ErrTransactionExists)
+			err = wc.DoTransactionWithPropagation(PropagationRequired, func(c context.Context) error {
+				return orm.WithContext(c).Insert(&TestOrmD222{Name: "with context"})
+			})
+			if err != nil {
+				return err
+			}
+			cnt, err = wc.SelectInt("select count(*) from test_orm_d222 where name = ?", "with context")
+			if err != nil {
+				return err
+			}
+			assert.Equal(t, cnt, int64(1))
+			assert.Equal(t, isUnscoped(wc.(*ORMTran).ctx), true)
+
+			//DoTransaction加入context中的事务，通过savepoint回滚时只回滚自己的部分
+			err = orm.WithContext(c).DoTransaction(func(inner *ORMTran) error {
+				if err := inner.Insert(&TestOrmD222{Name: "savepoint"}); err != nil {
+					return err
+				}
+				return errors.New("rollback savepoint")
+			})
+			assert.Equal(t, err.Error(), "rollback savepoint")
+			err = orm.WithContext(c).DoTransaction(func(inner *ORMTran) error {
+				return inner.Insert(&TestOrmD222{Name: "joined"})
+			})
+			if err != nil {
+				return err
+			}
+			cnt, err = orm.WithContext(c).SelectInt("select count(*) from test_orm_d222 where name in (?, ?)", "savepoint", "joined")
+			if err != nil {
+				return err
+			}
+			assert.Equal(t, cnt, int64(1))
+			assert.Equal(t, countByName("joined"), int64(0))
+			return errors.New("rollback")
+		})
+		assert.Equal(t, err.Error(), "rollback")
+		assert.Equal(t, countByName("required"), int64(0))
+		assert.Equal(t, countByName("requires new"), int64(1))
+		assert.Equal(t, countByName("joined"), int64(0))
+		assert.Equal(t, countByName("with context"), int64(0))
+
+		//没有事务时Required开始新的事务，Never直接执行
+		if err := insertD(context.Background(), PropagationRequired, "required"); err != nil {
+			t.Fatal(err)
+		}
+		if err := insertD(context.Background(), PropagationNever, "never"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, countByName("required"), int64(1))
+		assert.Equal(t, countByName("never"), int64(1))
+
+		//事务结束后context中的事务不再生效
+		var c context.Context
+		orm.DoTransaction(func(ot *ORMTran) error {
+			c = ot.Context()
+			return nil
+		})
+		if err := orm.WithContext(c).Insert(&TestOrmD222{Name: "after"}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, countByName("after"), int64(1))
+	})
+}
+
+var errTestCommit = errors.New("commit failed")
+
+// COMMIT总是失败的driver，用于测试提交失败时的返回值
+type commitErrDriver struct{}
+
+type commitErrConn struct{}
+
+type commitErrTx struct{}
+
+func (commitErrDriver) Open(string) (driver.Conn, error) { return commitErrConn{}, nil }
+
+func (commitErrConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+
+func (commitErrConn) Close() error { return nil }
+
+func (commitErrConn) Begin() (driver.Tx, error) { return commitErrTx{}, nil }
+
+func (commitErrTx) Commit() error { return errTestCommit }
+
+func (commitErrTx) Rollback() error { return nil }
+
+func init() {
+	sql.Register("orm_test_commit_err", commitErrDriver{})
+}
+
+func TestDoTransactionCommitError(t *testing.T) {
+	db, err := sql.Open("orm_test_commit_err", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	o := NewORMFromDB(db)
+
+	committed := false
+	err = o.DoTransaction(func(ot *ORMTran) error {
+		ot.OnCommit(func() { committed = true })
+		return nil
+	})
+	assert.Equal(t, err, errTestCommit)
+	assert.Equal(t, committed, false)
+
+	err = o.DoTransactionWithRetry(RetryOptions{MaxAttempts: 1}, func(ot *ORMTran) error {
+		return nil
+	})
+	assert.Equal(t, err, errTestCommit)
+}
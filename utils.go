@@ -44,12 +44,18 @@ func changeSQLIn(sql string, args ...interface{}) (string, []interface{}) {
 	return sql, newArgs
 }
 
+var lockClauseReg = regexp.MustCompile(`(?i)\s+(for\s+update|for\s+share|lock\s+in\s+share\s+mode)(\s+(nowait|skip\s+locked))?\s*;?\s*$`)
+
 //检测select 的sql中的select函数时候存在limit，0表示就补上limit 2000，1表示补上limit 1
 func addLimit(sql string, limitStatus int) string {
 	//判断select是否有limit这个关键字,检查子查询
 	if ok, _ := regexp.MatchString(`(?i)limit|^(?i)show`, sql); ok {
 		return sql
 	}
+	//limit需要加在for update等锁定语句之前
+	if loc := lockClauseReg.FindStringIndex(sql); loc != nil {
+		return addLimit(sql[:loc[0]], limitStatus) + strings.TrimSuffix(strings.TrimSpace(sql[loc[0]:]), ";")
+	}
 	sql = strings.TrimSuffix(sql, ";")
 	//最后一个匹配项
 	switch limitStatus {
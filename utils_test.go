@@ -14,4 +14,13 @@ func TestAddLimit(t *testing.T) {
 
 	str = addLimit(`show tables`, 0)
 	assert.Equal(t, "show tables", str)
+
+	str = addLimit(`select * from test_orm_a123 where test_id = ? for update;`, 1)
+	assert.Equal(t, "select * from test_orm_a123 where test_id = ? LIMIT 1 for update", str)
+
+	str = addLimit(`select * from test_orm_a123 LOCK IN SHARE MODE`, 0)
+	assert.Equal(t, "select * from test_orm_a123 LIMIT 2000 LOCK IN SHARE MODE", str)
+
+	str = addLimit(`select * from test_orm_a123 limit 10 for update`, 0)
+	assert.Equal(t, "select * from test_orm_a123 limit 10 for update", str)
 }
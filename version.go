@@ -0,0 +1,51 @@
+package orm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// s的版本号字段，没有version标签时返回nil，version标签的字段不是整数时返回错误
+func versionField(s interface{}) (*modelField, error) {
+	t := reflect.TypeOf(s)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, nil
+	}
+	m := getModelMeta(t)
+	return m.version, m.versionErr
+}
+
+func isVersionKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func increaseVersion(fv reflect.Value) {
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fv.SetInt(fv.Int() + 1)
+	default:
+		fv.SetUint(fv.Uint() + 1)
+	}
+}
+
+// 带版本号条件的update，影响的行数不是1时说明记录已经被修改或者删除，返回ErrStaleObject，成功后s中的版本号加1
+func execWithVersion(c context.Context, tdx Tdx, s interface{}, f *modelField, query string, args ...interface{}) error {
+	err := execWithRowAffectCheck(c, tdx, 1, query, args...)
+	if IsRowAffectError(err) {
+		return fmt.Errorf("%s %w", getTableName(s), ErrStaleObject)
+	}
+	if err != nil {
+		return err
+	}
+	increaseVersion(reflect.ValueOf(s).Elem().Field(f.index))
+	return nil
+}
@@ -0,0 +1,104 @@
+package orm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+)
+
+type TestOrmAccount struct {
+	ID      int64 `db:"id,pk,ai"`
+	Name    string
+	Balance int64
+	Version int `version:"true"`
+}
+
+func TestOptimisticLock(t *testing.T) {
+	oneTestScope(func(orm *ORM, testTableName string) {
+		account := &TestOrmAccount{Name: "a", Balance: 100}
+		if err := orm.Insert(account); err != nil {
+			t.Fatal(err)
+		}
+
+		var other TestOrmAccount
+		if err := orm.SelectByPK(&other, account.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		account.Balance = 80
+		if err := orm.UpdateByPK(account); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, account.Version, 1)
+
+		//other中的版本号已经过期
+		other.Balance = 50
+		err := orm.UpdateByPK(&other)
+		if !errors.Is(err, ErrStaleObject) {
+			t.Fatal("should be stale", err)
+		}
+		err = orm.UpdateFieldsByPK(&other, []string{"Balance"})
+		if !errors.Is(err, ErrStaleObject) {
+			t.Fatal("should be stale", err)
+		}
+		assert.Equal(t, other.Version, 0)
+
+		account.Balance = 70
+		if err := orm.UpdateFieldsByPK(account, []string{"Balance", "Version"}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, account.Version, 2)
+
+		//InsertOrUpdate时版本号不一致不会更新
+		stale := &TestOrmAccount{Name: "a", Balance: 10, Version: 1}
+		err = orm.InsertOrUpdate(stale, []string{"balance"})
+		if !errors.Is(err, ErrStaleObject) {
+			t.Fatal("should be stale", err)
+		}
+		fresh := &TestOrmAccount{Name: "a", Balance: 10, Version: 2}
+		if err := orm.InsertOrUpdate(fresh, []string{"balance"}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, fresh.Version, 3)
+
+		var loaded TestOrmAccount
+		if err := orm.SelectByPK(&loaded, account.ID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, loaded.Balance, int64(10))
+		assert.Equal(t, loaded.Version, 3)
+
+		inserted := &TestOrmAccount{Name: "b", Balance: 10}
+		if err := orm.InsertOrUpdate(inserted, []string{"balance"}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, inserted.Version, 0)
+
+		//删除后更新也会返回ErrStaleObject
+		if err := orm.DeleteByPK(&loaded); err != nil {
+			t.Fatal(err)
+		}
+		if err := orm.UpdateByPK(&loaded); !errors.Is(err, ErrStaleObject) {
+			t.Fatal("should be stale", err)
+		}
+	})
+}
+
+type testOrmStringVersion struct {
+	ID      int64  `db:"id,pk,ai"`
+	Version string `version:"true"`
+}
+
+func TestVersionFieldKind(t *testing.T) {
+	f, err := versionField(&TestOrmAccount{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, f.name, "Version")
+
+	//version标签只能用于整数字段
+	if _, err := versionField(&testOrmStringVersion{}); err == nil {
+		t.Fatal("should reject a non-integer version field")
+	}
+}